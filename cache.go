@@ -0,0 +1,290 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/howeyc/gopass"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	cacheMagic      = "PFCACHE1"
+	cacheSaltLen    = 16
+	cacheIterations = 100000
+)
+
+var errCacheEncrypted = errors.New("result cache is encrypted; supply its password with -encrypt-cache or $PINFINDER_CACHE_PASSWORD")
+
+// resultCache is set if the user enabled the result cache.
+var resultCache *cache
+
+// cacheEntry holds the outcome of processing a single backup.
+type cacheEntry struct {
+	Path           string
+	UDID           string
+	ManifestHash   string
+	LastBackup     time.Time
+	DisplayName    string
+	ProductVersion string
+	Status         string
+	Passcode       string
+	Failed         bool
+	UsesScreenTime bool
+	Key            []byte
+	Salt           []byte
+	Cached         time.Time
+}
+
+// cache stores the results of previous runs so that backups that haven't
+// changed don't need to be decrypted or brute forced again.
+//
+// Entries are keyed by the backup's path, UDID, a hash of its Manifest.plist
+// and its last backup date; if any of those change, the backup is reprocessed.
+// If password is set, the cache file is encrypted with AES-GCM using a key derived
+// from it.  It's safe for concurrent use.
+type cache struct {
+	mu       sync.Mutex // guards entries
+	fn       string
+	password string
+	entries  map[string]*cacheEntry
+}
+
+// defaultCacheFile returns the location of the cache file in the user's cache directory.
+func defaultCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "pinfinder", "results.cache")
+}
+
+// getCachePassword returns the cache password from the environment, or prompts for one.
+func getCachePassword() string {
+	if pw := os.Getenv("PINFINDER_CACHE_PASSWORD"); pw != "" {
+		return pw
+	}
+	fmt.Fprint(os.Stderr, "Enter result cache password: ")
+	pw, _ := gopass.GetPasswdMasked()
+	return string(pw)
+}
+
+// openCache loads the cache from fn.  A missing file results in an empty cache.
+func openCache(fn, password string) (*cache, error) {
+	c := &cache{fn: fn, password: password, entries: make(map[string]*cacheEntry)}
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result cache: %v", err)
+	}
+
+	if bytes.HasPrefix(data, []byte(cacheMagic)) {
+		if password == "" {
+			return nil, errCacheEncrypted
+		}
+		if data, err = decryptCache(data[len(cacheMagic):], password); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse result cache %s: %v", fn, err)
+	}
+	return c, nil
+}
+
+func cacheKey(password string, salt []byte) []byte {
+	return pbkdf2.Key([]byte(password), salt, cacheIterations, 32, sha256.New)
+}
+
+func decryptCache(data []byte, password string) ([]byte, error) {
+	if len(data) < cacheSaltLen {
+		return nil, errors.New("result cache is truncated")
+	}
+	salt, data := data[:cacheSaltLen], data[cacheSaltLen:]
+	aead, err := newCacheAEAD(cacheKey(password, salt))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("result cache is truncated")
+	}
+	nonce, data := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, []byte(cacheMagic))
+	if err != nil {
+		return nil, errors.New("incorrect result cache password")
+	}
+	return plain, nil
+}
+
+func encryptCache(data []byte, password string) ([]byte, error) {
+	salt := make([]byte, cacheSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newCacheAEAD(cacheKey(password, salt))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte(cacheMagic), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte(cacheMagic)), nil
+}
+
+func newCacheAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// save writes the cache back to disk, creating its directory if required.
+func (c *cache) save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if c.password != "" {
+		if data, err = encryptCache(data, c.password); err != nil {
+			return fmt.Errorf("failed to encrypt result cache: %v", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(c.fn), 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	if err := ioutil.WriteFile(c.fn, data, 0600); err != nil {
+		return fmt.Errorf("failed to write result cache: %v", err)
+	}
+	return nil
+}
+
+// identity returns the cache key for a backup along with the hash of its
+// Manifest.plist, or empty strings if the manifest can't be read.
+func (c *cache) identity(b *backup) (id, manifestHash string) {
+	data, err := fs.ReadFile(b.src.fsys, "Manifest.plist")
+	if err != nil {
+		return "", ""
+	}
+	mh := sha256.Sum256(data)
+	manifestHash = hex.EncodeToString(mh[:])
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%s",
+		b.Path, b.Info.UniqueIdentifier, manifestHash, b.Info.LastBackup.UTC().Format(time.RFC3339Nano))))
+	return hex.EncodeToString(key[:]), manifestHash
+}
+
+// apply copies a cached result into b, returning false if there isn't one.
+func (c *cache) apply(b *backup) bool {
+	id, _ := c.identity(b)
+	c.mu.Lock()
+	e := c.entries[id]
+	c.mu.Unlock()
+	if e == nil {
+		return false
+	}
+	b.Status = e.Status
+	b.Passcode = e.Passcode
+	b.Failed = e.Failed
+	b.UsesScreenTime = e.UsesScreenTime
+	b.Restrictions.Key = e.Key
+	b.Restrictions.Salt = e.Salt
+	b.Cached = true
+	return true
+}
+
+// store records the result for a backup if it's worth keeping.
+//
+// Results that depend on the supplied password, such as a missing or incorrect
+// encryption password, are not cached so that they're retried next time.
+func (c *cache) store(b *backup) {
+	if b.Cached || !(b.Passcode != "" || b.Failed || b.Status == msgNoPasscode) {
+		return
+	}
+	id, manifestHash := c.identity(b)
+	if id == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = &cacheEntry{
+		Path:           b.Path,
+		UDID:           b.Info.UniqueIdentifier,
+		ManifestHash:   manifestHash,
+		LastBackup:     b.Info.LastBackup,
+		DisplayName:    b.Info.DisplayName,
+		ProductVersion: b.Info.ProductVersion,
+		Status:         b.Status,
+		Passcode:       b.Passcode,
+		Failed:         b.Failed,
+		UsesScreenTime: b.UsesScreenTime,
+		Key:            b.Restrictions.Key,
+		Salt:           b.Restrictions.Salt,
+		Cached:         time.Now(),
+	}
+}
+
+// storeAll records the results for all backups and saves the cache.
+func (c *cache) storeAll(allBackups *backups) error {
+	for _, b := range allBackups.backups {
+		c.store(b)
+	}
+	return c.save()
+}
+
+// list writes a summary of the cached entries to w, most recent backup first.
+func (c *cache) list(w io.Writer) {
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastBackup.After(entries[j].LastBackup) })
+
+	fmt.Fprintf(w, "%-35.35s  %-7.7s  %-25s  %-25s  %s\n", "IOS DEVICE", "IOS", "BACKUP TIME", "CACHED", "RESULT")
+	for _, e := range entries {
+		result := e.Status
+		if e.Passcode != "" {
+			result = e.Passcode
+		}
+		fmt.Fprintf(w, "%-35.35s  %-7.7s  %-25s  %-25s  %s\n",
+			e.DisplayName,
+			e.ProductVersion,
+			e.LastBackup.In(time.Local).Format("Jan _2, 2006 03:04 PM MST"),
+			e.Cached.In(time.Local).Format("Jan _2, 2006 03:04 PM MST"),
+			result)
+	}
+	fmt.Fprintf(w, "\n%d cached results in %s\n", len(entries), c.fn)
+}
+
+// clearCache removes the cache file.
+func clearCache(fn string) error {
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove result cache: %v", err)
+	}
+	return nil
+}
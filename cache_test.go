@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheRoundTrip(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	defer func() { resultCache = nil }()
+
+	for _, pw := range []string{"", "secret"} {
+		fn := filepath.Join(tmpDir, "cache-"+pw)
+		c, err := openCache(fn, pw)
+		if err != nil {
+			t.Fatal("openCache failed", err)
+		}
+		resultCache = c
+
+		path := filepath.Join(tmpDir, "backup1")
+		b, _ := loadBackup(path)
+		if b == nil || b.Cached {
+			t.Fatal("Unexpected initial cache state")
+		}
+		b.findPasscode()
+		if err := c.storeAll(&backups{backups: []*backup{b}}); err != nil {
+			t.Fatal("storeAll failed", err)
+		}
+
+		if resultCache, err = openCache(fn, pw); err != nil {
+			t.Fatal("failed to reopen cache", err)
+		}
+		b, _ = loadBackup(path)
+		if !b.Cached {
+			t.Fatal("Result not loaded from cache")
+		}
+		if b.Passcode != dataPIN {
+			t.Errorf("Incorrect cached passcode %q", b.Passcode)
+		}
+	}
+}
+
+func TestCacheEncrypted(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+
+	fn := filepath.Join(tmpDir, "cache")
+	c, _ := openCache(fn, "secret")
+	if err := c.save(); err != nil {
+		t.Fatal("save failed", err)
+	}
+	if _, err := openCache(fn, ""); err != errCacheEncrypted {
+		t.Error("Expected errCacheEncrypted, got", err)
+	}
+	if _, err := openCache(fn, "wrong"); err == nil {
+		t.Error("Expected error opening cache with the wrong password")
+	}
+}
@@ -8,61 +8,170 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
 	"runtime"
+	"time"
+
+	"filippo.io/age"
 )
 
-func addSysinfoToZip(zf *zip.Writer) error {
+func addSysinfoToZip(d *diagBundle) error {
 	info := fmt.Sprintf(`OS: %s
 Arch: %s
 CPU Count: %d
 `, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
-	return addStringToZip(zf, "sysinfo.txt", info)
+	return d.addString("sysinfo.txt", "operating system, architecture and CPU count", info)
 }
 
 var captureFilenames = []string{restrictionsPlistName, "Status.plist"}
 
+// Redaction levels for diagnostic bundles.
+const (
+	redactNone     = "none"          // include everything
+	redactMetadata = "metadata-only" // remove passcodes and restrictions hashes
+	redactStrict   = "strict"        // also remove device names, identifiers and paths
+)
+
+var redactionLevels = []string{redactNone, redactMetadata, redactStrict}
+
+var redactionDescriptions = map[string]string{
+	redactNone:     "nothing is redacted; passcodes, restrictions hashes and device details are included",
+	redactMetadata: "passcodes, restrictions keys and salts and restrictions plists are removed",
+	redactStrict:   "passcodes, restrictions hashes, device names, UDIDs and backup paths are removed",
+}
+
+const redacted = "[REDACTED]"
+
+func mask(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactBackup returns a copy of b with the information that level doesn't
+// allow to be shared removed.  label replaces the backup's path in strict mode.
+func redactBackup(b *backup, level, label string) *backup {
+	r := *b
+	if level == redactNone {
+		return &r
+	}
+	r.Passcode = mask(r.Passcode)
+	r.Restrictions.Key, r.Restrictions.Salt = nil, nil
+	r.Keychain, r.KeychainEntries = nil, nil
+	r.restrictionsFile = ""
+	if level == redactStrict {
+		r.Path = label
+		r.RestrictionsPath = mask(r.RestrictionsPath)
+		r.Info.DisplayName = mask(r.Info.DisplayName)
+		r.Info.UniqueIdentifier = mask(r.Info.UniqueIdentifier)
+	}
+	return &r
+}
+
+// diagBundle writes a diagnostic zip, recording what was included or left out
+// so that it can be listed in MANIFEST.txt.
+type diagBundle struct {
+	zf       *zip.Writer
+	level    string
+	included [][2]string // file name and reason
+	omitted  [][2]string
+}
+
+// addString adds content to the bundle as name.
+func (d *diagBundle) addString(name, reason, content string) error {
+	d.included = append(d.included, [2]string{name, reason})
+	return addStringToZip(d.zf, name, content)
+}
+
+// addFile copies fpath from fsys into the bundle as name.
+func (d *diagBundle) addFile(fsys fs.FS, fpath, name, reason string) error {
+	d.included = append(d.included, [2]string{name, reason})
+	return addFileToZip(d.zf, fsys, fpath, name)
+}
+
+// omit records a file that was left out of the bundle.
+func (d *diagBundle) omit(name, reason string) {
+	d.omitted = append(d.omitted, [2]string{name, reason})
+}
+
+func (d *diagBundle) writeManifest() error {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "pinfinder diagnostic bundle")
+	fmt.Fprintf(&buf, "Created by PIN Finder %s at %s\n\n", version, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&buf, "Redaction level: %s\n  (%s)\n\n", d.level, redactionDescriptions[d.level])
+	fmt.Fprintln(&buf, "Included files:")
+	for _, e := range d.included {
+		fmt.Fprintf(&buf, "  %-70s %s\n", e[0], e[1])
+	}
+	if len(d.omitted) > 0 {
+		fmt.Fprintln(&buf, "\nOmitted files:")
+		for _, e := range d.omitted {
+			fmt.Fprintf(&buf, "  %-70s %s\n", e[0], e[1])
+		}
+	}
+	return addStringToZip(d.zf, "MANIFEST.txt", buf.String())
+}
+
 // addBackupInfoToZip retrieves information about the supplied backup
 // and adds some information about it to the zip file including:
 // * some human readable text information such as pathname, parsed pin information, etc
 // * A list of all the on-disk files in the backup (but not the contents or the unhashed filenames)
-// * The contents of the Status.plist and the restrictions information plist files.
+// * The contents of the Status.plist and, unless redacted, the restrictions information plist files.
+// * diag.json: the same in machine readable form, plus encryption parameters, Manifest.db schema and a processing trace.
 // No other information is included.
-func addBackupInfoToZip(zf *zip.Writer, b *backup) error {
-	fn := filepath.Base(b.Path)
-	if err := addStringToZip(zf, path.Join("backups", fn, "info.txt"), b.debugInfo()); err != nil {
+//
+// b should already have been redacted; src holds the unredacted backup's files.
+func addBackupInfoToZip(d *diagBundle, b *backup, src backupSource) error {
+	dir := path.Join("backups", filepath.Base(b.Path))
+	if err := d.addString(path.Join(dir, "info.txt"), "parsed backup metadata and passcode information", b.debugInfo()); err != nil {
+		return err
+	}
+	js, err := diagJSON(b, src, d.level)
+	if err != nil {
+		return err
+	}
+	if err := d.addString(path.Join(dir, "diag.json"), "machine readable metadata, encryption parameters, Manifest.db schema and processing trace", js); err != nil {
 		return err
 	}
 
 	// Enumerate the files the backup contains
 	var filelist bytes.Buffer
-	filepath.Walk(b.Path, func(fpath string, info os.FileInfo, err error) error {
+	fs.WalkDir(src.fsys, ".", func(fpath string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return nil
+		}
+		info, err := de.Info()
 		if err != nil {
 			return nil
 		}
-		if !info.IsDir() {
-			fmt.Fprintf(&filelist, "%-10d %s\n", info.Size(), fpath[len(b.Path)+1:])
-			if oneOf(path.Base(fpath), captureFilenames) {
-				addFileToZip(zf, fpath, path.Join("backups", fn, fpath[len(b.Path)+1:]))
-			}
+		fmt.Fprintf(&filelist, "%-10d %s\n", info.Size(), fpath)
+		if !oneOf(path.Base(fpath), captureFilenames) {
+			return nil
+		}
+		name := path.Join(dir, fpath)
+		switch {
+		case path.Base(fpath) == "Status.plist":
+			d.addFile(src.fsys, fpath, name, "backup status, copied from the backup")
+		case d.level != redactNone:
+			d.omit(name, "restrictions plist; contains the passcode hash")
+		default:
+			d.addFile(src.fsys, fpath, name, "restrictions plist, copied from the backup")
 		}
 		return nil
 	})
 
-	if err := addStringToZip(zf, path.Join("backups", fn, "filelist.txt"), filelist.String()); err != nil {
-		return err
-	}
-
-	return nil
+	return d.addString(path.Join(dir, "filelist.txt"), "sizes and hashed names of the files in the backup", filelist.String())
 }
 
-// addFileToZip copies a single file into the supplied zip using the given filename.
-func addFileToZip(zf *zip.Writer, path, fn string) error {
-	f, err := os.Open(path)
+// addFileToZip copies a single file from fsys into the supplied zip using the given filename.
+func addFileToZip(zf *zip.Writer, fsys fs.FS, path, fn string) error {
+	f, err := fsys.Open(path)
 	if err != nil {
 		return addStringToZip(zf, fn, fmt.Sprintf("failed to open file %s: %v", path, err))
 	}
@@ -77,7 +186,21 @@ func addFileToZip(zf *zip.Writer, path, fn string) error {
 
 // buildDebug constructs a .zip file containing debugging information in the given target
 // directory.  If targetDir is empty then it will use the user's home or desktop directory.
-func buildDebug(targetDir string, backupResult string, allBackups *backups) (fn string, err error) {
+// level sets the redaction level applied to the report and backup information.
+// If recipients isn't nil, the zip is encrypted to them.
+func buildDebug(targetDir, level string, allBackups *backups, recipients []age.Recipient) (fn string, err error) {
+	return writeBundle(targetDir, "pinfinder-debug.zip", level, allBackups, recipients, nil)
+}
+
+// writeBundle writes a diagnostic bundle called name holding the report and
+// backup information for allBackups.  If recipients isn't nil, the zip is
+// encrypted to them as it's written and diagEncryptedExt is added to its name.
+// If extra is not nil, it's called to add further files before the manifest is
+// written.  Nothing is left behind if writing the bundle fails.
+func writeBundle(targetDir, name, level string, allBackups *backups, recipients []age.Recipient, extra func(d *diagBundle) error) (fn string, err error) {
+	if !oneOf(level, redactionLevels) {
+		return "", fmt.Errorf("unknown redaction level %q", level)
+	}
 	if targetDir == "" {
 		targetDir, err = getDefaultDir()
 		if err != nil {
@@ -85,30 +208,78 @@ func buildDebug(targetDir string, backupResult string, allBackups *backups) (fn
 		}
 	}
 
-	fn = filepath.Join(targetDir, "pinfinder-debug.zip")
+	fn = filepath.Join(targetDir, name)
+	if recipients != nil {
+		fn += diagEncryptedExt
+	}
+	logger.Debug("writing diagnostic report", "file", fn, "redaction", level, "backups", len(allBackups.backups))
 	debugFile, err := os.Create(fn)
 	if err != nil {
 		return "", fmt.Errorf("Failed to open %s for write: %v", fn, err)
 	}
-	defer debugFile.Close()
+	defer func(fn string) {
+		if err != nil {
+			debugFile.Close()
+			os.Remove(fn)
+		}
+	}(fn)
 
-	zf := zip.NewWriter(debugFile)
-	defer zf.Close()
-	if err := addStringToZip(zf, "output.txt", backupResult); err != nil {
+	var w io.Writer = debugFile
+	var enc io.WriteCloser
+	if recipients != nil {
+		// encrypt the zip as it's written, so the unencrypted bundle never touches the disk
+		if enc, err = age.Encrypt(debugFile, recipients...); err != nil {
+			return "", fmt.Errorf("failed to encrypt diagnostic bundle: %v", err)
+		}
+		w = enc
+	}
+	zf := zip.NewWriter(w)
+	d := &diagBundle{zf: zf, level: level}
+
+	redactedBackups := &backups{encrypted: allBackups.encrypted}
+	for i, b := range allBackups.backups {
+		redactedBackups.backups = append(redactedBackups.backups, redactBackup(b, level, fmt.Sprintf("backup-%d", i+1)))
+	}
+
+	var report bytes.Buffer
+	generateReport(&report, true, redactedBackups)
+	if err := d.addString("output.txt", "pinfinder report for all backups", report.String()); err != nil {
 		return "", err
 	}
 
 	// Capture system info
-	if err := addSysinfoToZip(zf); err != nil {
+	if err := addSysinfoToZip(d); err != nil {
 		return "", err
 	}
 
-	for _, backup := range allBackups.backups {
-		if err := addBackupInfoToZip(zf, backup); err != nil {
+	for i, b := range redactedBackups.backups {
+		if err := addBackupInfoToZip(d, b, allBackups.backups[i].src); err != nil {
+			return "", err
+		}
+		logger.Debug("added backup to diagnostic report", "backup", b.Path)
+	}
+
+	if extra != nil {
+		if err := extra(d); err != nil {
 			return "", err
 		}
 	}
 
+	if err := d.writeManifest(); err != nil {
+		return "", err
+	}
+	if err := zf.Close(); err != nil {
+		return "", err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return "", fmt.Errorf("failed to encrypt diagnostic bundle: %v", err)
+		}
+	}
+	if err := debugFile.Close(); err != nil {
+		return "", err
+	}
+	logger.Debug("wrote diagnostic report", "file", fn, "included", len(d.included), "omitted", len(d.omitted))
 	return fn, nil
 }
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readZip returns the contents of each file in a zip file.
+func readZip(t *testing.T, fn string) map[string]string {
+	zr, err := zip.OpenReader(fn)
+	if err != nil {
+		t.Fatal("Failed to open zip", err)
+	}
+	defer zr.Close()
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(data)
+	}
+	return files
+}
+
+func TestBuildDebugRedaction(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	outDir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(outDir)
+
+	withPasswords(t, &passwordSource{})
+	dirs, _ := discoverBackups(tmpDir)
+	allBackups := new(backups)
+	allBackups.add(processBackups(dirs, true))
+
+	for _, level := range redactionLevels {
+		fn, err := buildDebug(outDir, level, allBackups, nil)
+		if err != nil {
+			t.Fatalf("%s: buildDebug failed: %v", level, err)
+		}
+		files := readZip(t, fn)
+
+		manifest, ok := files["MANIFEST.txt"]
+		if !ok || !strings.Contains(manifest, "Redaction level: "+level) {
+			t.Errorf("%s: missing or incorrect MANIFEST.txt: %q", level, manifest)
+		}
+		for name := range files {
+			if name != "MANIFEST.txt" && !strings.Contains(manifest, name) {
+				t.Errorf("%s: %s not listed in manifest", level, name)
+			}
+		}
+
+		var all strings.Builder
+		var restrictionsFiles int
+		for name, content := range files {
+			if name == "MANIFEST.txt" {
+				continue
+			}
+			all.WriteString(name + "\n" + content)
+			if strings.HasSuffix(name, restrictionsPlistName) {
+				restrictionsFiles++
+			}
+		}
+		hasPIN := strings.Contains(files["output.txt"], dataPIN)
+		hasName := strings.Contains(all.String(), "device one")
+		hasDir := strings.Contains(all.String(), "backup1")
+
+		switch level {
+		case redactNone:
+			if !hasPIN || !hasName || !hasDir || restrictionsFiles != 3 {
+				t.Errorf("none: expected unredacted content pin=%t name=%t dir=%t restrictions=%d", hasPIN, hasName, hasDir, restrictionsFiles)
+			}
+		case redactMetadata:
+			if hasPIN || !hasName || restrictionsFiles != 0 {
+				t.Errorf("metadata-only: incorrect redaction pin=%t name=%t restrictions=%d", hasPIN, hasName, restrictionsFiles)
+			}
+			if !strings.Contains(manifest, "Omitted files:") {
+				t.Error("metadata-only: omitted restrictions plists not listed")
+			}
+		case redactStrict:
+			if hasPIN || hasName || hasDir || restrictionsFiles != 0 {
+				t.Errorf("strict: incorrect redaction pin=%t name=%t dir=%t restrictions=%d", hasPIN, hasName, hasDir, restrictionsFiles)
+			}
+		}
+	}
+
+	if _, err := buildDebug(outDir, "bogus", allBackups, nil); err == nil {
+		t.Error("Expected error for unknown redaction level")
+	}
+}
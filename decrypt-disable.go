@@ -2,10 +2,20 @@
 
 package main
 
+import "errors"
+
 var (
 	decryptEnabled = false
 )
 
-func decrypt(backupDir string, b *backup) {
+func decrypt(b *backup) {
 	b.Status = msgEncryptionDisabled
 }
+
+func deriveKey(backupDir, pw string) (string, error) {
+	return "", errors.New(msgEncryptionDisabled)
+}
+
+func describeEncryption(src backupSource) *encryptionDiag {
+	return &encryptionDiag{Error: msgEncryptionDisabled}
+}
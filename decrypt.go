@@ -4,6 +4,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
 
 	plist "github.com/DHowett/go-plist"
 	iosbackup "github.com/gwatts/ios/backup"
@@ -14,47 +19,185 @@ var (
 	decryptEnabled = true
 )
 
-func decrypt(backupDir string, b *backup) {
-	pw := getpw()
-	if pw == "" {
-		b.Status = msgIsEncrypted
-		return
+// openBackup prepares the encrypted backup held by b for decryption.
+//
+// The ios library reads some files directly from disk; if the backup is held
+// in an archive, it's given a temporary directory to copy them into, which is
+// removed by the returned cleanup function.
+func openBackup(b *backup) (encbw *iosbackup.MobileBackup, cleanup func(), err error) {
+	var manifest struct {
+		BackupKeyBag []byte
+		ManifestKey  []byte
+	}
+	var status struct {
+		Version string
+	}
+	if err := parsePlist(b.src.fsys, "Manifest.plist", &manifest); err != nil {
+		return nil, nil, err
+	}
+	if err := parsePlist(b.src.fsys, "Status.plist", &status); err != nil {
+		return nil, nil, err
+	}
+
+	encbw = &iosbackup.MobileBackup{Dir: b.src.dir, Version: status.Version}
+	encbw.Manifest.BackupKeyBag = manifest.BackupKeyBag
+	encbw.Manifest.ManifestKey = manifest.ManifestKey
+	if encbw.Keybag, err = readKeybag(manifest.BackupKeyBag); err != nil {
+		return nil, nil, err
+	}
+
+	cleanup = func() {}
+	if encbw.Dir == "" {
+		if encbw.Dir, err = ioutil.TempDir("", "pinfinder-backup"); err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.RemoveAll(encbw.Dir) }
+		// iOS 10.0 keeps the password salt in Manifest.db, which the ios
+		// library reads from encbw.Dir when the password is set.
+		if encbw.Version == iosbackup.BackupVersioniOS10 {
+			if err := stageFile(b.src.fsys, "Manifest.db", encbw.Dir); err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+		}
 	}
-	encbw, err := iosbackup.Open(backupDir)
+	return encbw, cleanup, nil
+}
+
+// deriveKey derives the keybag key for an iOS 10.2+ backup from its password.
+// The hex encoded result can be passed back with -backup-key to skip the slow
+// derivation step on later runs.
+func deriveKey(backupDir, pw string) (string, error) {
+	encbw, cleanup, err := openBackup(&backup{src: dirSource(backupDir)})
 	if err != nil {
-		b.Status = "Failed to open backup: " + err.Error()
-		return
+		return "", errors.New("Failed to open backup: " + err.Error())
 	}
-	if err := encbw.SetPassword(pw); err != nil {
-		b.Status = msgIncorrectPassword
-		return
+	defer cleanup()
+	if encbw.Version < iosbackup.BackupVersioniOS102 {
+		return "", errors.New("backup keys can only be derived for backups of iOS 10.2 and later")
+	}
+	key, err := encbw.Keybag.SetPassword(pw, true)
+	if err != nil {
+		return "", errors.New(msgIncorrectPassword)
+	}
+	return hex.EncodeToString([]byte(key)), nil
+}
+
+// unlockWithKey attempts to unlock the keybag using the key supplied with -backup-key.
+func unlockWithKey(encbw *iosbackup.MobileBackup) bool {
+	if backupKey == nil || encbw.Version < iosbackup.BackupVersioniOS102 {
+		return false
+	}
+	// The keybag treats a 64 character hex string as an already derived key.
+	return encbw.SetPassword(hex.EncodeToString(backupKey)) == nil
+}
+
+func decrypt(b *backup) {
+	var encbw *iosbackup.MobileBackup
+	cleanup := func() {}
+	defer func() { cleanup() }()
+
+	events.emit(backupEvent(eventDecryptStarted, b))
+	start := time.Now()
+	defer func() {
+		e := backupEvent(eventDecryptFinished, b)
+		e.Status, e.UnlockedBy, e.Elapsed = b.Status, b.UnlockedBy, time.Since(start).Seconds()
+		events.emit(e)
+		b.noteTime("decrypt", start)
+	}()
+	open := func() error {
+		if encbw != nil {
+			return nil
+		}
+		eb, c, err := openBackup(b)
+		if err != nil {
+			b.noteErr("open", err)
+			return err
+		}
+		encbw, cleanup = eb, c
+		b.note("open", "backup version %s, keybag with %d class keys", encbw.Version, len(encbw.Keybag.Keys))
+		return nil
+	}
+
+	if backupKey != nil {
+		if err := open(); err != nil {
+			b.Status = "Failed to open backup: " + err.Error()
+			return
+		}
+		if unlockWithKey(encbw) {
+			b.UnlockedBy = unlockedByKey
+			b.note("unlock", "unlocked by the -backup-key key")
+		} else {
+			b.note("unlock", "the -backup-key key didn't unlock the backup")
+		}
+	}
+
+	if b.UnlockedBy == "" {
+		var tried int
+		by, err := passwords.unlock(b, func(pw string) error {
+			if err := open(); err != nil {
+				return err
+			}
+			tried++
+			e := backupEvent(eventPasswordTried, b)
+			e.Tried = tried
+			events.emit(e)
+			if err := encbw.SetPassword(pw); err != nil {
+				return errBadPassword
+			}
+			return nil
+		})
+		switch err {
+		case nil:
+			b.UnlockedBy = by
+			b.note("unlock", "unlocked by %s after %d password attempts", by, tried)
+		case errNoPassword, errBadPassword:
+			b.noteErr("unlock", err)
+			b.Status = err.Error()
+			return
+		default:
+			b.Status = "Failed to open backup: " + err.Error()
+			return
+		}
+	}
+
+	// Only the record holding the passcode information is needed.
+	recordID := restrictionsPlistName
+	if b.isIOS12() {
+		recordID = keychainRecordID
 	}
-	if err := encbw.Load(); err != nil {
+	if err := loadRecords(b, encbw, recordID); err != nil {
 		b.Status = err.Error()
+		b.noteErr("manifest", err)
 		return
 	}
+	b.note("manifest", "loaded %d manifest records for %s", len(encbw.Records), recordID)
 	if b.isIOS12() {
 		b.UsesScreenTime = true
 		kc, err := keychain.Load(encbw)
 		if err != nil {
 			b.Status = msgKeychainLoadFailed
+			b.noteErr("keychain", err)
 			return
 		}
-		b.Keychain = kc
+		b.Keychain = backupKeychain{kc}
 	} else {
 		rec := encbw.RecordById(restrictionsPlistName)
 		if rec == nil {
+			b.note("restrictions", "the manifest has no record for the restrictions plist")
 			b.Status = msgNoPassword
 			return
 		}
 		data, err := encbw.ReadFile(*rec)
 		if err != nil {
 			b.Status = msgIncorrectPassword
+			b.noteErr("restrictions", err)
 			return
 		}
 		buf := bytes.NewReader(data)
 		if err := plist.NewDecoder(buf).Decode(&b.Restrictions); err != nil {
 			b.Status = msgIncorrectPassword
+			b.noteErr("restrictions", err)
 			return
 		}
 	}
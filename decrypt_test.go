@@ -0,0 +1,192 @@
+// +build !nodecrypt
+
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+func TestGeneratedBackups(t *testing.T) {
+	withPasswords(t, &passwordSource{candidates: []candidate{{genPassword, "test"}}})
+
+	for _, preset := range backupgen.Presets(genPassword, genPasscode) {
+		t.Run(preset.Name, func(t *testing.T) {
+			dir, _ := ioutil.TempDir("", "pinfinder")
+			defer os.RemoveAll(dir)
+			if err := backupgen.Generate(dir, preset.Options); err != nil {
+				t.Fatal("Generate failed", err)
+			}
+
+			b, err := loadBackup(dir)
+			if err != nil {
+				t.Fatal("loadBackup failed", err)
+			}
+			b.findPasscode()
+			if b.Passcode != genPasscode {
+				t.Errorf("Incorrect passcode %q status=%q", b.Passcode, b.Status)
+			}
+			if b.isEncrypted() && b.UnlockedBy != "test" {
+				t.Errorf("Incorrect UnlockedBy %q", b.UnlockedBy)
+			}
+		})
+	}
+}
+
+func TestGeneratedArchives(t *testing.T) {
+	withPasswords(t, &passwordSource{candidates: []candidate{{genPassword, "test"}}})
+
+	dir := t.TempDir()
+	presets := backupgen.Presets(genPassword, genPasscode)
+	for i, preset := range presets {
+		if err := backupgen.Generate(filepath.Join(dir, "sync", fmt.Sprintf("backup%d", i+1)), preset.Options); err != nil {
+			t.Fatal("Generate failed", err)
+		}
+	}
+	zipfn := filepath.Join(dir, "backups.zip")
+	tarfn := filepath.Join(dir, "backups.tar.gz")
+	writeZip(t, filepath.Join(dir, "sync"), zipfn)
+	writeTarGz(t, filepath.Join(dir, "sync"), tarfn)
+
+	for _, fn := range []string{zipfn, tarfn} {
+		sources, cleanup, err := openArchive(fn)
+		if err != nil {
+			t.Fatalf("openArchive(%s) failed: %v", fn, err)
+		}
+		results := make(map[string]*backup)
+		for _, b := range processBackups(sources, true) {
+			results[b.Info.DisplayName] = b
+		}
+		for _, preset := range presets {
+			b := results[preset.Options.DeviceName]
+			if b == nil {
+				t.Errorf("%s: %s backup not loaded", fn, preset.Name)
+			} else if b.Passcode != genPasscode {
+				t.Errorf("%s: %s: incorrect passcode %q status=%q", fn, preset.Name, b.Passcode, b.Status)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestGeneratedBadPassword(t *testing.T) {
+	withPasswords(t, &passwordSource{candidates: []candidate{{"wrong", "test"}}})
+
+	dir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(dir)
+	opts := presetOptions(t, "legacy encrypted (iOS 11)")
+	if err := backupgen.Generate(dir, opts); err != nil {
+		t.Fatal("Generate failed", err)
+	}
+
+	b, err := loadBackup(dir)
+	if err != nil {
+		t.Fatal("loadBackup failed", err)
+	}
+	if b.Status != msgIncorrectPassword || b.Passcode != "" {
+		t.Errorf("Unexpected result status=%q passcode=%q", b.Status, b.Passcode)
+	}
+}
+
+func TestGeneratedBackupKey(t *testing.T) {
+	withPasswords(t, &passwordSource{})
+
+	dir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(dir)
+	opts := presetOptions(t, "Screen Time encrypted (iOS 12)")
+	if err := backupgen.Generate(filepath.Join(dir, "backup"), opts); err != nil {
+		t.Fatal("Generate failed", err)
+	}
+
+	key, err := deriveKey(filepath.Join(dir, "backup"), genPassword)
+	if err != nil {
+		t.Fatal("deriveKey failed", err)
+	}
+	saved := backupKey
+	defer func() { backupKey = saved }()
+	if backupKey, err = hex.DecodeString(key); err != nil {
+		t.Fatal("Invalid key", err)
+	}
+
+	b, err := loadBackup(filepath.Join(dir, "backup"))
+	if err != nil {
+		t.Fatal("loadBackup failed", err)
+	}
+	b.findPasscode()
+	if b.Passcode != genPasscode || b.UnlockedBy != unlockedByKey {
+		t.Errorf("Unexpected result passcode=%q unlockedBy=%q status=%q", b.Passcode, b.UnlockedBy, b.Status)
+	}
+}
+
+func TestGeneratedDiagJSON(t *testing.T) {
+	withPasswords(t, &passwordSource{candidates: []candidate{{genPassword, "test"}}})
+
+	dir := t.TempDir()
+	for _, name := range []string{"legacy plain (iOS 11)", "legacy encrypted (iOS 11)"} {
+		if err := backupgen.Generate(filepath.Join(dir, "sync", name), presetOptions(t, name)); err != nil {
+			t.Fatal("Generate failed", err)
+		}
+	}
+	// Plain backups have an unencrypted Manifest.db
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "sync", "legacy plain (iOS 11)", "Manifest.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE Files (fileID TEXT PRIMARY KEY, domain TEXT, relativePath TEXT, flags INTEGER, file BLOB)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	sources, _ := discoverBackups(filepath.Join(dir, "sync"))
+	allBackups := new(backups)
+	allBackups.add(processBackups(sources, true))
+
+	for _, level := range []string{redactNone, redactStrict} {
+		fn, err := buildDebug(dir, level, allBackups, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := readZip(t, fn)
+		for i, b := range allBackups.backups {
+			name := filepath.Base(b.Path)
+			if level == redactStrict {
+				name = fmt.Sprintf("backup-%d", i+1)
+			}
+			content, ok := files["backups/"+name+"/diag.json"]
+			if !ok {
+				t.Fatalf("%s: no diag.json for %s", level, name)
+			}
+			var d struct {
+				Path       string
+				Result     hookResult
+				Encryption *encryptionDiag
+				ManifestDB *manifestDBDiag
+				Trace      []traceStep
+			}
+			if err := json.Unmarshal([]byte(content), &d); err != nil {
+				t.Fatalf("%s: invalid diag.json: %v", level, err)
+			}
+			if d.Result.Outcome != outcomeFound || len(d.Trace) == 0 {
+				t.Errorf("%s %s: unexpected result %+v, %d trace steps", level, name, d.Result, len(d.Trace))
+			}
+			if d.ManifestDB == nil || len(d.ManifestDB.Tables) == 0 || d.ManifestDB.Decrypted != b.isEncrypted() {
+				t.Errorf("%s %s: missing manifest schema: %+v", level, name, d.ManifestDB)
+			}
+			if b.isEncrypted() && (d.Encryption == nil || d.Encryption.Iterations == 0 || d.Encryption.ManifestKeyClass == nil) {
+				t.Errorf("%s %s: missing encryption parameters: %+v", level, name, d.Encryption)
+			}
+			if level == redactStrict && (strings.Contains(content, dir) || d.Result.UDID != redacted || d.Result.Passcode != "") {
+				t.Errorf("strict %s: diag.json isn't redacted:\n%s", name, content)
+			}
+		}
+	}
+}
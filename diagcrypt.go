@@ -0,0 +1,196 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// diagKeys holds the comma separated age public keys that -diag-encrypt
+// encrypts diagnostic bundles to.  It's empty unless set at build time with
+//
+//	go build -ldflags "-X main.diagKeys=age1..."
+var diagKeys = ""
+
+// Encrypted diagnostic bundles are standard age files (https://age-encryption.org),
+// so they can be decrypted with diag-open or the age command line tool.
+const (
+	diagCryptHeader   = "age-encryption.org/v1" // first line of every age file
+	diagPublicPrefix  = "age1"
+	diagEncryptedExt  = ".age"
+	diagDefaultSecret = "pinfinder-diag.key"
+)
+
+// parseDiagRecipients parses a comma separated list of public keys or files
+// holding public keys, one per line.
+func parseDiagRecipients(spec string) (keys []age.Recipient, err error) {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, diagPublicPrefix) {
+			key, err := age.ParseX25519Recipient(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %q: %v", entry, err)
+			}
+			keys = append(keys, key)
+			continue
+		}
+		f, err := os.Open(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key file: %v", err)
+		}
+		fkeys, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry, err)
+		}
+		keys = append(keys, fkeys...)
+	}
+	return keys, nil
+}
+
+// diagRecipients returns the keys diagnostic bundles should be encrypted to,
+// or nil if they shouldn't be encrypted.
+func diagRecipients() ([]age.Recipient, error) {
+	var spec []string
+	if *diagEncrypt {
+		if diagKeys == "" && *diagKey == "" {
+			return nil, errors.New("this build of pinfinder has no embedded diagnostic keys; supply one with -diag-key")
+		}
+		spec = append(spec, diagKeys)
+	}
+	if *diagKey != "" {
+		spec = append(spec, *diagKey)
+	}
+	if len(spec) == 0 {
+		return nil, nil
+	}
+	keys, err := parseDiagRecipients(strings.Join(spec, ","))
+	if err == nil && len(keys) == 0 {
+		err = errors.New("no diagnostic public keys supplied")
+	}
+	return keys, err
+}
+
+// readDiagIdentities reads the secret keys from a file created by diag-keygen
+// or age-keygen.
+func readDiagIdentities(fn string) ([]age.Identity, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret key: %v", err)
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fn, err)
+	}
+	return ids, nil
+}
+
+// decryptDiagFile decrypts the bundle in fn to out using any of ids.  out
+// must not already exist, and is removed if decryption fails part way through.
+func decryptDiagFile(fn, out string, ids []age.Identity) error {
+	in, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := age.Decrypt(in, ids...)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(out)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(out)
+		return err
+	}
+	return nil
+}
+
+func runDiagKeygen(args []string) {
+	args = parseCommandFlags(args)
+	if len(args) > 1 {
+		exit(102, true, "diag-keygen takes at most one secret key filename")
+	}
+	fn := diagDefaultSecret
+	if len(args) == 1 {
+		fn = args[0]
+	}
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		exit(116, false, err.Error())
+	}
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		exit(116, false, "Failed to create secret key file: %v", err)
+	}
+	// Same layout as age-keygen, so the file can be used with age -d -i
+	fmt.Fprintf(f, "# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), id.Recipient(), id)
+	if err := f.Close(); err != nil {
+		exit(116, false, "Failed to write secret key file: %v", err)
+	}
+	fmt.Println("Secret key written to", fn)
+	fmt.Println("Public key:", id.Recipient())
+	fmt.Printf("\nUsers can encrypt diagnostic reports to it with: %s -diag -diag-key %s\n\n", path.Base(os.Args[0]), id.Recipient())
+	exit(0, false, "")
+}
+
+func runDiagOpen(args []string) {
+	args = parseCommandFlags(args)
+	if len(args) < 2 || len(args) > 3 {
+		exit(102, true, "diag-open requires an encrypted bundle, a secret key file and optionally an output filename")
+	}
+	ids, err := readDiagIdentities(args[1])
+	if err != nil {
+		exit(116, false, err.Error())
+	}
+
+	out := strings.TrimSuffix(args[0], diagEncryptedExt)
+	if len(args) == 3 {
+		out = args[2]
+	}
+	if out == args[0] {
+		out += ".zip"
+	}
+	if err := decryptDiagFile(args[0], out, ids); err != nil {
+		exit(116, false, "Failed to decrypt %s: %v", args[0], err)
+	}
+	fmt.Println("Decrypted diagnostic bundle written to", out)
+	fmt.Println()
+
+	zr, err := zip.OpenReader(out)
+	if err != nil {
+		exit(116, false, "Decrypted bundle isn't a valid zip file: %v", err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.Name != "MANIFEST.txt" {
+			continue
+		}
+		if rc, err := f.Open(); err == nil {
+			io.Copy(os.Stdout, rc)
+			rc.Close()
+		}
+	}
+	exit(0, false, "")
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func genDiagKey(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestDiagRecipients(t *testing.T) {
+	pub := genDiagKey(t).Recipient().String()
+	fn := filepath.Join(t.TempDir(), "keys.txt")
+	if err := ioutil.WriteFile(fn, []byte("# maintainer\n"+pub+"\n\n"+pub+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := parseDiagRecipients(pub + ", " + fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("expected 3 keys, got %d", len(keys))
+	}
+
+	for _, bad := range []string{"age1short", genDiagKey(t).String(), "no-such-file"} {
+		if _, err := parseDiagRecipients(bad); err == nil {
+			t.Errorf("no error for %q", bad)
+		}
+	}
+}
+
+func TestBuildDebugEncrypted(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	outDir := t.TempDir()
+
+	withPasswords(t, &passwordSource{})
+	dirs, _ := discoverBackups(tmpDir)
+	allBackups := new(backups)
+	allBackups.add(processBackups(dirs, true))
+
+	id1, id2, other := genDiagKey(t), genDiagKey(t), genDiagKey(t)
+	fn, err := buildDebug(outDir, redactNone, allBackups, []age.Recipient{id1.Recipient(), id2.Recipient()})
+	if err != nil {
+		t.Fatal("buildDebug failed", err)
+	}
+	if filepath.Base(fn) != "pinfinder-debug.zip"+diagEncryptedExt {
+		t.Errorf("unexpected filename %s", fn)
+	}
+	if entries, _ := ioutil.ReadDir(outDir); len(entries) != 1 {
+		t.Errorf("expected only the encrypted bundle in %s, found %d files", outDir, len(entries))
+	}
+	enc, _ := ioutil.ReadFile(fn)
+	if !strings.HasPrefix(string(enc), diagCryptHeader) || strings.Contains(string(enc), "MANIFEST.txt") {
+		t.Fatal("bundle isn't encrypted")
+	}
+
+	for i, id := range []*age.X25519Identity{id1, id2} {
+		out := filepath.Join(outDir, fmt.Sprintf("decrypted%d.zip", i+1))
+		if err := decryptDiagFile(fn, out, []age.Identity{id}); err != nil {
+			t.Fatalf("recipient %d: %v", i+1, err)
+		}
+		if err := decryptDiagFile(fn, out, []age.Identity{id}); !os.IsExist(err) {
+			t.Errorf("recipient %d: expected an error overwriting %s, got %v", i+1, out, err)
+		}
+		if files := readZip(t, out); !strings.Contains(files["MANIFEST.txt"], "Redaction level: "+redactNone) {
+			t.Errorf("recipient %d: incorrect MANIFEST.txt", i+1)
+		}
+	}
+
+	out := filepath.Join(outDir, "other.zip")
+	var noMatch *age.NoIdentityMatchError
+	if err := decryptDiagFile(fn, out, []age.Identity{other}); !errors.As(err, &noMatch) {
+		t.Errorf("unexpected error for another key: %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Error("output was created for another key")
+	}
+}
+
+func TestWriteBundleRemovesPartialFile(t *testing.T) {
+	outDir := t.TempDir()
+	recipients := []age.Recipient{genDiagKey(t).Recipient()}
+	for _, r := range [][]age.Recipient{nil, recipients} {
+		_, err := writeBundle(outDir, "bundle.zip", redactNone, new(backups), r, func(d *diagBundle) error {
+			return errors.New("failed")
+		})
+		if err == nil {
+			t.Fatal("no error from writeBundle")
+		}
+		if entries, _ := ioutil.ReadDir(outDir); len(entries) != 0 {
+			t.Errorf("encrypted=%t: %s left behind", r != nil, entries[0].Name())
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// backupDiag is the machine readable description of a backup written to
+// diag.json in diagnostic bundles.
+type backupDiag struct {
+	Path             string          `json:"path"`
+	Result           hookResult      `json:"result"`
+	RestrictionsPath string          `json:"restrictionsPath,omitempty"`
+	Info             interface{}     `json:"info"`
+	Manifest         interface{}     `json:"manifestPlist,omitempty"`
+	StatusPlist      interface{}     `json:"statusPlist,omitempty"`
+	Restrictions     restrictionDiag `json:"restrictions"`
+	Encryption       *encryptionDiag `json:"encryption,omitempty"`
+	ManifestDB       *manifestDBDiag `json:"manifestDB,omitempty"`
+	Trace            []traceStep     `json:"trace"`
+}
+
+// restrictionDiag describes the restrictions passcode hash; Key and Salt are
+// omitted when redacted.
+type restrictionDiag struct {
+	KeyLength  int    `json:"keyLength"`
+	SaltLength int    `json:"saltLength"`
+	Key        []byte `json:"key,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+}
+
+// encryptionDiag holds the encryption parameters of an encrypted backup's keybag.
+type encryptionDiag struct {
+	KeybagVersion              uint32   `json:"keybagVersion"`
+	KeybagType                 uint32   `json:"keybagType"`
+	KeybagUUID                 string   `json:"keybagUUID,omitempty"`
+	Wrap                       uint32   `json:"wrap"`
+	Iterations                 uint32   `json:"iterations"`
+	DoubleProtectionIterations uint32   `json:"doubleProtectionIterations,omitempty"`
+	Classes                    []uint32 `json:"classes"`
+	ManifestKeyClass           *uint32  `json:"manifestKeyClass,omitempty"`
+	Error                      string   `json:"error,omitempty"`
+}
+
+// manifestDBDiag describes the tables of a Manifest.db sqlite database.
+type manifestDBDiag struct {
+	Decrypted bool        `json:"decrypted,omitempty"`
+	Tables    []tableDiag `json:"tables,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type tableDiag struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+	Rows   int64  `json:"rows"`
+}
+
+// describeManifestDB lists the tables in db with their schema and row counts.
+func describeManifestDB(db *sql.DB, decrypted bool) *manifestDBDiag {
+	d := &manifestDBDiag{Decrypted: decrypted}
+	rows, err := db.Query("SELECT name, sql FROM sqlite_master WHERE type = 'table' ORDER BY name")
+	if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	for rows.Next() {
+		var t tableDiag
+		var schema sql.NullString
+		if err := rows.Scan(&t.Name, &schema); err != nil {
+			d.Error = err.Error()
+			break
+		}
+		t.Schema = schema.String
+		d.Tables = append(d.Tables, t)
+	}
+	rows.Close()
+
+	for i, t := range d.Tables {
+		quoted := `"` + strings.Replace(t.Name, `"`, `""`, -1) + `"`
+		if err := db.QueryRow("SELECT count(*) FROM " + quoted).Scan(&d.Tables[i].Rows); err != nil {
+			d.Error = err.Error()
+		}
+	}
+	return d
+}
+
+// readManifestDB describes the unencrypted Manifest.db held by src, if any.
+func readManifestDB(src backupSource) *manifestDBDiag {
+	if !fileExists(src.fsys, "Manifest.db") {
+		return nil
+	}
+	uriEscape := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+	dsn := "file:" + uriEscape.Replace(filepath.ToSlash(filepath.Join(src.dir, "Manifest.db"))) + "?mode=ro"
+	if src.dir == "" {
+		tmpDir, err := ioutil.TempDir("", "pinfinder-manifest")
+		if err != nil {
+			return &manifestDBDiag{Error: err.Error()}
+		}
+		defer os.RemoveAll(tmpDir)
+		if err := stageFile(src.fsys, "Manifest.db", tmpDir); err != nil {
+			return &manifestDBDiag{Error: err.Error()}
+		}
+		dsn = filepath.Join(tmpDir, "Manifest.db")
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return &manifestDBDiag{Error: err.Error()}
+	}
+	defer db.Close()
+	return describeManifestDB(db, false)
+}
+
+// newBackupDiag describes the backup b, which should already have been
+// redacted to level.  src holds the unredacted backup's files.
+func newBackupDiag(b *backup, src backupSource, level string) backupDiag {
+	d := backupDiag{
+		Path:             b.Path,
+		Result:           newHookResult(b, level == redactNone),
+		RestrictionsPath: b.RestrictionsPath,
+		Info:             b.Info,
+		Restrictions: restrictionDiag{
+			KeyLength:  len(b.Restrictions.Key),
+			SaltLength: len(b.Restrictions.Salt),
+			Key:        b.Restrictions.Key,
+			Salt:       b.Restrictions.Salt,
+		},
+		ManifestDB: b.manifestDB,
+		Trace:      b.trace,
+	}
+	if d.Trace == nil {
+		d.Trace = []traceStep{}
+	}
+
+	var manifest struct {
+		Version        string
+		Date           time.Time
+		IsEncrypted    bool
+		WasPasscodeSet bool
+	}
+	if err := parsePlist(src.fsys, "Manifest.plist", &manifest); err == nil {
+		d.Manifest = manifest
+	}
+	var status struct {
+		Version       string
+		SnapshotState string
+		BackupState   string
+		Date          time.Time
+		IsFullBackup  bool
+		UUID          string
+	}
+	if err := parsePlist(src.fsys, "Status.plist", &status); err == nil {
+		if level == redactStrict {
+			status.UUID = mask(status.UUID)
+		}
+		d.StatusPlist = status
+	}
+
+	if b.isEncrypted() {
+		d.Encryption = describeEncryption(src)
+		if d.Encryption != nil && level == redactStrict {
+			d.Encryption.KeybagUUID = mask(d.Encryption.KeybagUUID)
+		}
+	} else if d.ManifestDB == nil {
+		d.ManifestDB = readManifestDB(src)
+	}
+
+	if level == redactStrict && src.path != "" {
+		// Errors and notes may mention the backup's location.
+		d.Trace = redactTrace(d.Trace, src.path, b.Path)
+	}
+	return d
+}
+
+// redactTrace returns a copy of trace with the path from replaced by to.
+func redactTrace(trace []traceStep, from, to string) []traceStep {
+	unpath := strings.NewReplacer(from, to).Replace
+	steps := make([]traceStep, len(trace))
+	for i, s := range trace {
+		s.Detail, s.Error = unpath(s.Detail), unpath(s.Error)
+		if s.Causes != nil {
+			causes := make([]string, len(s.Causes))
+			for j, c := range s.Causes {
+				causes[j] = unpath(c)
+			}
+			s.Causes = causes
+		}
+		steps[i] = s
+	}
+	return steps
+}
+
+// diagJSON returns the diag.json content for b.
+func diagJSON(b *backup, src backupSource, level string) (string, error) {
+	data, err := json.MarshalIndent(newBackupDiag(b, src, level), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
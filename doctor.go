@@ -0,0 +1,270 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Results of a doctor check.
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// check is a single item in the doctor's checklist.
+type check struct {
+	result string
+	name   string
+	detail string
+	hint   string // how to fix a warning or failure
+}
+
+// doctor collects the results of checks on the environment and backups.
+type doctor struct {
+	checks []check
+}
+
+func (d *doctor) pass(name, format string, a ...interface{}) {
+	d.checks = append(d.checks, check{checkPass, name, fmt.Sprintf(format, a...), ""})
+}
+
+func (d *doctor) warn(name, hint, format string, a ...interface{}) {
+	d.checks = append(d.checks, check{checkWarn, name, fmt.Sprintf(format, a...), hint})
+}
+
+func (d *doctor) fail(name, hint, format string, a ...interface{}) {
+	d.checks = append(d.checks, check{checkFail, name, fmt.Sprintf(format, a...), hint})
+}
+
+// failed returns the number of checks that failed.
+func (d *doctor) failed() (n int) {
+	for _, c := range d.checks {
+		if c.result == checkFail {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *doctor) print(w io.Writer) {
+	counts := make(map[string]int)
+	for _, c := range d.checks {
+		counts[c.result]++
+		fmt.Fprintf(w, "[%s] %s: %s\n", c.result, c.name, c.detail)
+		if c.hint != "" {
+			fmt.Fprintf(w, "       Fix: %s\n", c.hint)
+		}
+	}
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed\n", counts[checkPass], counts[checkWarn], counts[checkFail])
+}
+
+// checkEnvironment checks the build and the sync directories, then each
+// backup found in them.  dirs may name sync directories or backups; if
+// empty, the standard sync directories for the OS are checked.
+func (d *doctor) checkEnvironment(dirs []string) {
+	if decryptEnabled {
+		d.pass("Decryption support", "this build can read encrypted backups")
+	} else {
+		d.warn("Decryption support", "rebuild pinfinder without -tags nodecrypt",
+			"this build was made with the nodecrypt tag and can't read encrypted backups")
+	}
+
+	if len(dirs) == 0 {
+		candidates, err := candidateSyncDirs()
+		if err != nil {
+			d.fail("Sync directories", "pass the directory holding your backups on the command line", "%v", err)
+			return
+		}
+		dirs = candidates
+	}
+
+	var found int
+	for _, dir := range dirs {
+		if isArchive(dir) {
+			found += d.checkArchive(dir)
+			continue
+		}
+		if fileExists(os.DirFS(dir), "Info.plist") {
+			d.checkBackup(dirSource(dir))
+			found++
+			continue
+		}
+		sources := d.checkSyncDir(dir, len(dirs) > 1)
+		for _, src := range sources {
+			d.checkBackup(src)
+		}
+		found += len(sources)
+	}
+	if found == 0 {
+		d.fail("Backups", "back up the device to this computer with iTunes or Finder, or pass the backup's location",
+			"no backups found")
+	}
+}
+
+// checkSyncDir checks that dir exists and can be read, returning the backups it holds.
+// A missing directory is only a warning if optional is set, as there are other
+// places the backups may be.
+func (d *doctor) checkSyncDir(dir string, optional bool) (sources []backupSource) {
+	name := "Sync directory " + dir
+	fi, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		hint := "back up the device to this computer with iTunes or Finder, or pass the backup's location"
+		if optional {
+			d.warn(name, hint, "doesn't exist")
+		} else {
+			d.fail(name, hint, "doesn't exist")
+		}
+		return nil
+	case err != nil:
+		d.failRead(name, err)
+		return nil
+	case !fi.IsDir():
+		d.fail(name, "pass the directory holding the backups", "isn't a directory")
+		return nil
+	}
+
+	sources, err = discoverBackups(dir)
+	if err != nil {
+		d.failRead(name, err)
+		return nil
+	}
+	d.pass(name, "readable (mode %s), %d possible backups", fi.Mode().Perm(), len(sources))
+	return sources
+}
+
+// checkArchive checks that the zip or tar archive fn can be read, and checks
+// each backup it holds, returning the number of backups found.
+func (d *doctor) checkArchive(fn string) int {
+	name := "Archive " + fn
+	sources, cleanup, err := openArchive(fn)
+	if err != nil {
+		d.fail(name, "check that the file is a complete zip or tar archive of the backups", "%v", err)
+		return 0
+	}
+	defer cleanup()
+	d.pass(name, "readable, %d possible backups", len(sources))
+	for _, src := range sources {
+		d.checkBackup(src)
+	}
+	return len(sources)
+}
+
+// failRead records a failure to read a file or directory, with a hint suited to the cause.
+func (d *doctor) failRead(name string, err error) {
+	switch {
+	case isBadMacPerms(err) != nil:
+		d.fail(name, "grant Full Disk Access to Terminal in System Preferences > Security & Privacy; see https://pinfinder.net/mac.html",
+			"operation not permitted")
+	case os.IsPermission(err):
+		hint := "check the permissions of the directory, or run pinfinder as the user that owns the backups"
+		if runtime.GOOS == "windows" {
+			hint = "check the directory's security settings, or run pinfinder as the user that owns the backups"
+		}
+		d.fail(name, hint, "permission denied: %v", err)
+	default:
+		d.fail(name, "", "%v", err)
+	}
+}
+
+// checkBackup checks that src holds the files pinfinder needs, and that the
+// backup can hold a passcode pinfinder is able to recover.
+func (d *doctor) checkBackup(src backupSource) {
+	name := "Backup " + filepath.Base(src.path)
+	b, err := loadBackupInfo(src)
+	if err != nil {
+		switch {
+		case isBadMacPerms(err) != nil || os.IsPermission(err):
+			d.failRead(name, err)
+		case !fileExists(src.fsys, "Info.plist") || !fileExists(src.fsys, "Manifest.plist"):
+			d.fail(name, "the backup is incomplete; back up the device again", "Info.plist or Manifest.plist is missing")
+		default:
+			d.fail(name, "the backup may be damaged; back up the device again", "failed to read backup metadata: %v", err)
+		}
+		return
+	}
+	name = fmt.Sprintf("Backup %s (%s, iOS %s)", filepath.Base(src.path), b.Info.DisplayName, b.Info.ProductVersion)
+
+	// Decrypting a backup also requires its Status.plist and manifest.
+	required := []string{"Info.plist", "Manifest.plist"}
+	if b.isEncrypted() {
+		required = append(required, "Status.plist")
+	}
+	var missing []string
+	for _, fn := range required {
+		if err := canRead(src.fsys, fn); err != nil {
+			missing = append(missing, fn)
+		}
+	}
+	if b.isEncrypted() && canRead(src.fsys, "Manifest.db") != nil && canRead(src.fsys, "Manifest.mbdb") != nil {
+		missing = append(missing, "Manifest.db")
+	}
+	if len(missing) > 0 {
+		d.fail(name, "the backup is incomplete or unreadable; back up the device again", "missing or unreadable: %v", missing)
+		return
+	}
+
+	fingerprint, complete, err := backupSnapshot(src)
+	switch {
+	case err != nil:
+		d.warn(name, "back up the device again", "can't read Status.plist: %v", err)
+		return
+	case !complete:
+		d.warn(name, "wait for the backup to finish, or back up the device again", "the backup wasn't completed (%s)", fingerprint)
+		return
+	}
+
+	major := majorVersion(b.Info.ProductVersion)
+	switch {
+	case major >= 13:
+		d.warn(name, "see https://pinfinder.net/faq.html#ios13",
+			"iOS 13 and later don't store the passcode in backups")
+	case major >= 12 && !b.isEncrypted():
+		d.fail(name, "enable \"Encrypt local backup\" in iTunes or Finder and back up the device again",
+			"the backup isn't encrypted; the Screen Time passcode is only included in encrypted backups")
+	case b.isEncrypted() && !decryptEnabled:
+		d.fail(name, "use a build of pinfinder without the nodecrypt tag",
+			"the backup is encrypted and this build can't decrypt it")
+	case b.isEncrypted():
+		if enc := describeEncryption(src); enc.Error != "" {
+			d.fail(name, "the backup may be damaged; back up the device again", "can't read the encryption keybag: %s", enc.Error)
+			return
+		}
+		d.pass(name, "encrypted backup is complete; the encryption password will be needed")
+	default:
+		d.pass(name, "backup is complete")
+	}
+}
+
+// canRead checks that fn can be opened and read.
+func canRead(fsys fs.FS, fn string) error {
+	f, err := fsys.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Read(make([]byte, 1))
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func runDoctor(args []string) {
+	dirs := parseCommandFlags(args)
+	var d doctor
+	d.checkEnvironment(dirs)
+	d.print(os.Stdout)
+	if d.failed() > 0 {
+		exit(117, false, "")
+	}
+	exit(0, false, "")
+}
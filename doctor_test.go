@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	plist "github.com/DHowett/go-plist"
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+func TestDoctor(t *testing.T) {
+	tmpDir := t.TempDir()
+	syncDir := filepath.Join(tmpDir, "sync")
+	generate := func(name string, opts backupgen.Options) {
+		if err := backupgen.Generate(filepath.Join(syncDir, name), opts); err != nil {
+			t.Fatal("Generate failed", err)
+		}
+	}
+
+	generate("good", presetOptions(t, "legacy plain (iOS 9)"))
+	unencrypted := presetOptions(t, "legacy plain (iOS 9)")
+	unencrypted.ProductVersion = "12.4"
+	generate("ios12-unencrypted", unencrypted)
+	generate("uploading", presetOptions(t, "legacy plain (iOS 11)"))
+	status, _ := plist.Marshal(map[string]interface{}{"SnapshotState": "uploading", "UUID": "x"}, plist.XMLFormat)
+	ioutil.WriteFile(filepath.Join(syncDir, "uploading", "Status.plist"), status, 0644)
+	generate("no-manifest", presetOptions(t, "legacy encrypted (iOS 11)"))
+	os.Remove(filepath.Join(syncDir, "no-manifest", "Manifest.db"))
+	os.Mkdir(filepath.Join(syncDir, "empty"), 0755)
+
+	var d doctor
+	d.checkEnvironment([]string{syncDir, filepath.Join(tmpDir, "missing")})
+	var out bytes.Buffer
+	d.print(&out)
+
+	results := make(map[string]string)
+	for _, c := range d.checks {
+		for _, name := range []string{"good", "ios12-unencrypted", "uploading", "no-manifest", "empty", "missing"} {
+			if strings.Contains(c.name, name) {
+				results[name] = c.result
+			}
+		}
+	}
+	expected := map[string]string{
+		"good":              checkPass,
+		"ios12-unencrypted": checkFail,
+		"uploading":         checkWarn,
+		"no-manifest":       checkFail,
+		"empty":             checkFail,
+		"missing":           checkWarn, // another sync directory was given
+	}
+	for name, result := range expected {
+		if results[name] != result {
+			t.Errorf("%s: expected %s, got %q", name, result, results[name])
+		}
+	}
+	if d.failed() != 3 {
+		t.Errorf("expected 3 failures, got %d", d.failed())
+	}
+	if !strings.Contains(out.String(), "Encrypt local backup") {
+		t.Errorf("missing remediation hint in output:\n%s", out.String())
+	}
+}
+
+func TestDoctorArchive(t *testing.T) {
+	tmpDir := t.TempDir()
+	backupDir := filepath.Join(tmpDir, "backups")
+	if err := backupgen.Generate(filepath.Join(backupDir, "good"), presetOptions(t, "legacy plain (iOS 11)")); err != nil {
+		t.Fatal("Generate failed", err)
+	}
+	tarfn := filepath.Join(tmpDir, "backups.tar.gz")
+	writeTarGz(t, backupDir, tarfn)
+	badfn := filepath.Join(tmpDir, "bad.zip")
+	ioutil.WriteFile(badfn, []byte("not a zip file"), 0644)
+
+	var d doctor
+	d.checkEnvironment([]string{tarfn})
+	if d.failed() != 0 {
+		var out bytes.Buffer
+		d.print(&out)
+		t.Errorf("unexpected failures checking %s:\n%s", tarfn, out.String())
+	}
+	var checkedBackup bool
+	for _, c := range d.checks {
+		if strings.Contains(c.name, "Backup good") && c.result == checkPass {
+			checkedBackup = true
+		}
+	}
+	if !checkedBackup {
+		t.Error("backup in the archive wasn't checked")
+	}
+
+	d = doctor{}
+	d.checkEnvironment([]string{badfn})
+	if d.failed() != 2 { // the archive, and no backups found
+		t.Errorf("expected 2 failures for %s, got %d", badfn, d.failed())
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	eventDiscovered      = "backup_discovered"
+	eventDecryptStarted  = "decrypt_started"
+	eventPasswordTried   = "password_tried"
+	eventDecryptFinished = "decrypt_finished"
+	eventSearchStarted   = "search_started"
+	eventSearchProgress  = "search_progress"
+	eventResult          = "result"
+)
+
+// event reports the progress of work on a backup.
+//
+// Every event includes the time, type and backup path; the remaining fields
+// are set where relevant to the event type:
+//
+//	backup_discovered  device, iosVersion, lastBackup, encrypted
+//	decrypt_started    device
+//	password_tried     tried (count of passwords tried so far for the backup)
+//	decrypt_finished   status (empty on success), unlockedBy, elapsedSeconds
+//	search_started     total (number of passcodes to try)
+//	search_progress    tried, total
+//	result             passcode, status, failed, cached
+type event struct {
+	Time       time.Time  `json:"time"`
+	Type       string     `json:"type"`
+	Path       string     `json:"path"`
+	Device     string     `json:"device,omitempty"`
+	IOSVersion string     `json:"iosVersion,omitempty"`
+	LastBackup *time.Time `json:"lastBackup,omitempty"`
+	Encrypted  bool       `json:"encrypted,omitempty"`
+	Tried      int        `json:"tried,omitempty"`
+	Total      int        `json:"total,omitempty"`
+	Status     string     `json:"status,omitempty"`
+	UnlockedBy string     `json:"unlockedBy,omitempty"`
+	Elapsed    float64    `json:"elapsedSeconds,omitempty"`
+	Passcode   string     `json:"passcode,omitempty"`
+	Failed     bool       `json:"failed,omitempty"`
+	Cached     bool       `json:"cached,omitempty"`
+}
+
+// events distributes progress events to interested handlers.
+var events = new(eventBus)
+
+// eventBus calls each subscribed handler with every emitted event.  Handlers
+// are called one at a time, so needn't be safe for concurrent use, and
+// shouldn't block.
+type eventBus struct {
+	mu       sync.Mutex
+	handlers map[int]func(event)
+	next     int
+}
+
+// subscribe registers fn to receive events, returning a function that
+// removes it again.
+func (eb *eventBus) subscribe(fn func(event)) (unsubscribe func()) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if eb.handlers == nil {
+		eb.handlers = make(map[int]func(event))
+	}
+	id := eb.next
+	eb.next++
+	eb.handlers[id] = fn
+	return func() {
+		eb.mu.Lock()
+		defer eb.mu.Unlock()
+		delete(eb.handlers, id)
+	}
+}
+
+func (eb *eventBus) emit(e event) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if len(eb.handlers) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, fn := range eb.handlers {
+		fn(e)
+	}
+}
+
+// backupEvent returns an event of type typ for b.
+func backupEvent(typ string, b *backup) event {
+	return event{Type: typ, Path: b.Path, Device: b.Info.DisplayName}
+}
+
+func discoveredEvent(b *backup) event {
+	e := backupEvent(eventDiscovered, b)
+	e.IOSVersion = b.Info.ProductVersion
+	e.LastBackup = &b.Info.LastBackup
+	e.Encrypted = b.isEncrypted()
+	return e
+}
+
+func resultEvent(b *backup) event {
+	e := backupEvent(eventResult, b)
+	e.Passcode = b.Passcode
+	e.Status = b.Status
+	e.Failed = b.Failed
+	e.Cached = b.Cached
+	return e
+}
+
+// jsonEventWriter returns an event handler that writes each event to w as a
+// line of JSON.
+func jsonEventWriter(w io.Writer) func(event) {
+	enc := json.NewEncoder(w)
+	return func(e event) {
+		enc.Encode(e)
+	}
+}
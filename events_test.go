@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+// collectEvents records events until the test completes.
+func collectEvents(t *testing.T) func() []event {
+	var mu sync.Mutex
+	var collected []event
+	t.Cleanup(events.subscribe(func(e event) {
+		mu.Lock()
+		collected = append(collected, e)
+		mu.Unlock()
+	}))
+	return func() []event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]event(nil), collected...)
+	}
+}
+
+func countEvents(evs []event, typ, path string) (n int) {
+	for _, e := range evs {
+		if e.Type == typ && (path == "" || e.Path == path) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestProcessEvents(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	if decryptEnabled {
+		opts := presetOptions(t, "Screen Time encrypted (iOS 12)")
+		if err := backupgen.Generate(filepath.Join(tmpDir, "ios12"), opts); err != nil {
+			t.Fatal("Generate failed", err)
+		}
+	}
+	withPasswords(t, &passwordSource{candidates: []candidate{{"wrong", "test"}, {genPassword, "test"}}})
+	collected := collectEvents(t)
+
+	dirs, _ := discoverBackups(tmpDir)
+	loaded := processBackups(dirs, true)
+	evs := collected()
+
+	if n := countEvents(evs, eventDiscovered, ""); n != len(loaded) {
+		t.Errorf("Expected %d discovered events, got %d", len(loaded), n)
+	}
+	if n := countEvents(evs, eventResult, ""); n != len(loaded) {
+		t.Errorf("Expected %d result events, got %d", len(loaded), n)
+	}
+
+	b1 := filepath.Join(tmpDir, "backup1")
+	if n := countEvents(evs, eventSearchStarted, b1); n != 1 {
+		t.Errorf("Expected 1 search_started event, got %d", n)
+	}
+	if n := countEvents(evs, eventSearchProgress, b1); n == 0 {
+		t.Error("No search_progress events")
+	}
+	for _, e := range evs {
+		if e.Type == eventResult && e.Path == b1 && e.Passcode != dataPIN {
+			t.Errorf("Incorrect result event %#v", e)
+		}
+	}
+
+	if !decryptEnabled {
+		return
+	}
+	ios12 := filepath.Join(tmpDir, "ios12")
+	if n := countEvents(evs, eventPasswordTried, ios12); n != 2 {
+		t.Errorf("Expected 2 password_tried events, got %d", n)
+	}
+	for _, e := range evs {
+		if e.Type == eventDecryptFinished && e.Path == ios12 && (e.Status != "" || e.UnlockedBy != "test") {
+			t.Errorf("Unexpected decrypt_finished event %#v", e)
+		}
+	}
+}
+
+func TestJSONEventWriter(t *testing.T) {
+	var buf bytes.Buffer
+	eb := new(eventBus)
+	unsubscribe := eb.subscribe(jsonEventWriter(&buf))
+	eb.emit(event{Type: eventSearchProgress, Path: "/tmp/x", Tried: 500, Total: maxPIN})
+	eb.emit(event{Type: eventResult, Path: "/tmp/x", Passcode: "1234"})
+	unsubscribe()
+	eb.emit(event{Type: eventResult, Path: "/tmp/y"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	var e event
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal("Invalid JSON", err)
+	}
+	if e.Type != eventSearchProgress || e.Tried != 500 || e.Time.IsZero() {
+		t.Errorf("Incorrect event %#v", e)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+const failureReportName = "pinfinder-failure.zip"
+
+// expectedStatuses are the results that describe the backup rather than a
+// problem with pinfinder, and so don't need a failure report.
+var expectedStatuses = []string{
+	"",
+	msgNoPasscode,
+	msgIsEncrypted,
+	msgEncryptionDisabled,
+	msgIncorrectPassword,
+	msgNoPassword,
+	msgEncryptedNeeded,
+}
+
+// needsFailureReport returns true if the passcode search failed, or the
+// passcode information couldn't be extracted for an unexpected reason.
+func needsFailureReport(b *backup) bool {
+	return b.Failed || !oneOf(b.Status, expectedStatuses)
+}
+
+// buildFailureReport writes a strictly redacted bundle describing the backups
+// in failed, along with what was tried for each, to targetDir.
+func buildFailureReport(targetDir string, failed *backups) (string, error) {
+	return writeBundle(targetDir, failureReportName, redactStrict, failed, nil, func(d *diagBundle) error {
+		return d.addString("failure.txt", "what went wrong and which passcodes and parameters were tried", failureSummary(failed))
+	})
+}
+
+// failureSummary describes why each backup failed and what was tried.
+// Backups are labelled as they are in a strictly redacted bundle.
+func failureSummary(failed *backups) string {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "pinfinder failure report")
+	fmt.Fprintf(&buf, "PIN Finder %s on %s/%s with %d CPUs\n", version, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+
+	for i, b := range failed.backups {
+		label := fmt.Sprintf("backup-%d", i+1)
+		trace := b.trace
+		status := b.Status
+		if b.src.path != "" {
+			trace = redactTrace(trace, b.src.path, label)
+			status = strings.Replace(status, b.src.path, label, -1)
+		}
+
+		fmt.Fprintf(&buf, "\n%s (%s, iOS %s, %s)\n", label, b.Info.ProductType, b.Info.ProductVersion, encryptedDesc(b))
+		fmt.Fprintf(&buf, "  Result: %s\n", status)
+		switch {
+		case len(b.Restrictions.Key) > 0:
+			fmt.Fprintf(&buf, "  Searched: passcodes 0000-%04d (%d candidates)\n", maxPIN-1, maxPIN)
+			fmt.Fprintf(&buf, "  Hash: PBKDF2-HMAC-SHA1, %d iterations, %d byte key, %d byte salt\n",
+				restrictionsIterations, len(b.Restrictions.Key), len(b.Restrictions.Salt))
+		case b.UsesScreenTime && b.Keychain != nil:
+			fmt.Fprintln(&buf, "  Searched: Screen Time passcode entries in the decrypted keychain")
+		case b.UsesScreenTime:
+			fmt.Fprintln(&buf, "  Searched: nothing; the keychain couldn't be read")
+		default:
+			fmt.Fprintln(&buf, "  Searched: nothing; the restrictions passcode information couldn't be read")
+		}
+		for _, s := range trace {
+			if s.Error == "" {
+				continue
+			}
+			fmt.Fprintf(&buf, "  Error in %s: %s\n", s.Step, s.Error)
+			for _, c := range s.Causes {
+				fmt.Fprintf(&buf, "    caused by %s\n", c)
+			}
+		}
+	}
+	return buf.String()
+}
+
+func encryptedDesc(b *backup) string {
+	if b.isEncrypted() {
+		return "encrypted"
+	}
+	return "not encrypted"
+}
+
+// reportFailures writes a failure report for any backups that need one,
+// records its filename on each of them and tells the user which file to
+// attach to a bug report.
+func reportFailures(allBackups *backups) {
+	if !*failureReport {
+		return
+	}
+	failed := &backups{encrypted: allBackups.encrypted}
+	for _, b := range allBackups.backups {
+		if needsFailureReport(b) {
+			failed.backups = append(failed.backups, b)
+		}
+	}
+	if len(failed.backups) == 0 {
+		return
+	}
+	fn, err := buildFailureReport(*diagDir, failed)
+	if err != nil {
+		logger.Warn("failed to write failure report", "error", err)
+		return
+	}
+	for _, b := range failed.backups {
+		b.failureReport = fn
+	}
+	fmt.Fprintf(os.Stderr, "Passcode recovery failed unexpectedly for %d backup(s).\n", len(failed.backups))
+	fmt.Fprintf(os.Stderr, "Please attach %s to a bug report at https://github.com/gwatts/pinfinder/issues\n\n", fn)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNeedsFailureReport(t *testing.T) {
+	tests := []struct {
+		b        backup
+		expected bool
+	}{
+		{backup{Passcode: "1234"}, false},
+		{backup{Status: msgNoPasscode}, false},
+		{backup{Status: msgIncorrectPassword}, false},
+		{backup{Status: msgPINNotFound, Failed: true}, true},
+		{backup{Status: msgKeychainLoadFailed}, true},
+		{backup{Status: "plist: error parsing XML property list"}, true},
+	}
+	for _, test := range tests {
+		if actual := needsFailureReport(&test.b); actual != test.expected {
+			t.Errorf("status=%q failed=%t: expected %t, got %t", test.b.Status, test.b.Failed, test.expected, actual)
+		}
+	}
+}
+
+func TestBuildFailureReport(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	outDir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(outDir)
+
+	b, err := loadBackup(filepath.Join(tmpDir, "backup1"))
+	if err != nil {
+		t.Fatal("loadBackup failed", err)
+	}
+	b.Restrictions.Key[0] ^= 0xff // no passcode will match
+	b.findPasscode()
+	if !b.Failed {
+		t.Fatalf("expected search to fail; status=%q", b.Status)
+	}
+	b.noteErr("extract", errors.New("failed to read "+b.src.path))
+
+	fn, err := buildFailureReport(outDir, &backups{backups: []*backup{b}})
+	if err != nil {
+		t.Fatal("buildFailureReport failed", err)
+	}
+	if filepath.Base(fn) != failureReportName {
+		t.Errorf("incorrect filename %q", fn)
+	}
+	files := readZip(t, fn)
+	summary := files["failure.txt"]
+	for _, expected := range []string{
+		"backup-1 (",
+		"Result: " + msgPINNotFound,
+		"Searched: passcodes 0000-9999 (10000 candidates)",
+		"PBKDF2-HMAC-SHA1, 1000 iterations",
+		"Error in extract: failed to read backup-1",
+	} {
+		if !strings.Contains(summary, expected) {
+			t.Errorf("failure.txt missing %q:\n%s", expected, summary)
+		}
+	}
+	for name, content := range files {
+		if strings.Contains(content, tmpDir) || strings.Contains(content, "device one") {
+			t.Errorf("%s contains unredacted details", name)
+		}
+	}
+	if !strings.Contains(files["MANIFEST.txt"], "Redaction level: strict") {
+		t.Error("failure report isn't strictly redacted")
+	}
+}
+
+func TestReportFailures(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	outDir := t.TempDir()
+	savedDir, savedReport := *diagDir, *failureReport
+	defer func() { *diagDir, *failureReport = savedDir, savedReport }()
+	*diagDir = outDir
+
+	for _, enabled := range []bool{false, true} {
+		*failureReport = enabled
+		failed, err := loadBackup(filepath.Join(tmpDir, "backup1"))
+		if err != nil {
+			t.Fatal("loadBackup failed", err)
+		}
+		failed.Restrictions.Key[0] ^= 0xff // no passcode will match
+		failed.findPasscode()
+		ok, err := loadBackup(filepath.Join(tmpDir, "backup1"))
+		if err != nil {
+			t.Fatal("loadBackup failed", err)
+		}
+		ok.findPasscode()
+		reportFailures(&backups{backups: []*backup{failed, ok}})
+
+		expected := ""
+		if enabled {
+			expected = filepath.Join(outDir, failureReportName)
+		}
+		if failed.failureReport != expected {
+			t.Errorf("enabled=%t: expected failure report %q, got %q", enabled, expected, failed.failureReport)
+		}
+		if ok.failureReport != "" {
+			t.Errorf("enabled=%t: failure report recorded for a successful search", enabled)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+const statusData = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Version</key>
+	<string>3.3</string>
+	<key>SnapshotState</key>
+	<string>finished</string>
+</dict>
+</plist>
+`
+
+// fuzzSeeds returns the Info.plist, Manifest.plist, Status.plist and
+// restrictions plist of each test fixture, plus backups generated by backupgen.
+func fuzzSeeds(f *testing.F) [][4][]byte {
+	seeds := [][4][]byte{
+		{mkInfo("2014-11-25T21:39:29Z", "device one"), mkManifest(false), []byte(statusData), []byte(pinData)},
+		{mkInfo("2014-11-24T20:39:29Z", "device three"), mkManifest(true), []byte(statusData), []byte("this would be an encrypted plist")},
+		{mkInfo("2016-09-23T21:39:29Z", "ios10 device"), mkManifest(false), nil, []byte("not a plist")},
+	}
+
+	tmpDir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(tmpDir)
+	for i, preset := range backupgen.Presets(genPassword, genPasscode) {
+		dir := filepath.Join(tmpDir, string('a'+rune(i)))
+		if err := backupgen.Generate(dir, preset.Options); err != nil {
+			f.Fatal("Generate failed", err)
+		}
+		var seed [4][]byte
+		for j, fn := range []string{"Info.plist", "Manifest.plist", "Status.plist"} {
+			seed[j], _ = ioutil.ReadFile(filepath.Join(dir, fn))
+		}
+		seed[3] = backupgen.RestrictionsPlist(genPasscode)
+		seeds = append(seeds, seed)
+	}
+	return seeds
+}
+
+func FuzzParsePlist(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		for _, data := range seed {
+			f.Add(data)
+		}
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fsys := fstest.MapFS{"test.plist": {Data: data}}
+		var b backup
+		var status struct{ Version string }
+		parsePlist(fsys, "test.plist", &b.Info)
+		parsePlist(fsys, "test.plist", &b.Manifest)
+		parsePlist(fsys, "test.plist", &b.Restrictions)
+		parsePlist(fsys, "test.plist", &status)
+		b.isEncrypted()
+		b.isIOS12()
+	})
+}
+
+// FuzzLoadBackup runs the backup loading code over fuzzed backup plists.
+//
+// Encrypted backups are opened with a fixed -backup-key, which exercises the
+// keybag parsing without spending time on key derivation.
+func FuzzLoadBackup(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed[0], seed[1], seed[2], seed[3])
+	}
+	savedKey, savedPasswords := backupKey, passwords
+	defer func() { backupKey, passwords = savedKey, savedPasswords }()
+	backupKey = make([]byte, 32)
+	passwords = &passwordSource{}
+
+	f.Fuzz(func(t *testing.T, info, manifest, status, restrictions []byte) {
+		fsys := fstest.MapFS{
+			"Info.plist":     {Data: info},
+			"Manifest.plist": {Data: manifest},
+			"Status.plist":   {Data: status},
+			path.Join(restrictionsPlistName[:2], restrictionsPlistName): {Data: restrictions},
+		}
+		b, err := loadBackupInfo(backupSource{fsys: fsys, path: "fuzz"})
+		if err != nil {
+			return
+		}
+		b.isEncrypted()
+		b.extract()
+	})
+}
@@ -1,14 +1,15 @@
 module github.com/gwatts/pinfinder
 
 require (
+	filippo.io/age v1.0.0
 	github.com/DHowett/go-plist v0.0.0-20180609054337-500bd5b9081b
 	github.com/chiefbrain/ios v0.0.0-20170407113533-c740def7cc9f // indirect
 	github.com/dunhamsteve/plist v0.0.0-20141002024612-b6f98fbbce4a // indirect
 	github.com/gwatts/ios v0.0.0-20181019043743-b3fd07f7716f
 	github.com/howeyc/gopass v0.0.0-20170109162249-bf9dde6d0d2c
 	github.com/kr/pretty v0.1.0
-	github.com/mattn/go-sqlite3 v1.9.0 // indirect
-	golang.org/x/crypto v0.0.0-20181015023909-0c41d7ab0a0e
-	golang.org/x/sys v0.0.0-20181011152604-fa43e7bc11ba // indirect
+	github.com/mattn/go-sqlite3 v1.9.0
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	golang.org/x/sys v0.0.0-20210903071746-97244b99971b // indirect
 	howett.net/plist v0.0.0-20180609054337-500bd5b9081b // indirect
 )
@@ -0,0 +1,66 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// restrictionsIterations is the PBKDF2 iteration count iOS uses for the
+// restrictions passcode hash.
+const restrictionsIterations = 1000
+
+// hashExporter formats a restrictions key and salt for an external cracking tool.
+type hashExporter struct {
+	ext    string
+	format func(key, salt []byte) string
+}
+
+var hashExporters = []hashExporter{
+	{"hashcat", hashcatHash},
+	{"john", johnHash},
+}
+
+// hashcatHash formats a key and salt using hashcat's PBKDF2-HMAC-SHA1 format (mode 12000).
+func hashcatHash(key, salt []byte) string {
+	return fmt.Sprintf("sha1:%d:%s:%s", restrictionsIterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(key))
+}
+
+// johnHash formats a key and salt using John the Ripper's pbkdf2-hmac-sha1 format.
+func johnHash(key, salt []byte) string {
+	return fmt.Sprintf("$pbkdf2-hmac-sha1$%d.%s.%s", restrictionsIterations,
+		hex.EncodeToString(salt),
+		hex.EncodeToString(key))
+}
+
+// exportHashes writes the restrictions hash of each backup that has one to
+// a file per supported tool, named prefix.hashcat and prefix.john.
+//
+// Each line is tagged with the backup directory name so that it can be
+// matched back to its backup (use hashcat's --username option).
+// Screen Time backups store the passcode directly, so have nothing to export.
+func exportHashes(prefix string, allBackups *backups) (filenames []string, err error) {
+	for _, exp := range hashExporters {
+		var buf bytes.Buffer
+		for _, b := range allBackups.backups {
+			if len(b.Restrictions.Key) == 0 {
+				continue
+			}
+			fmt.Fprintf(&buf, "%s:%s\n", filepath.Base(b.Path), exp.format(b.Restrictions.Key, b.Restrictions.Salt))
+		}
+		fn := prefix + "." + exp.ext
+		if err := ioutil.WriteFile(fn, buf.Bytes(), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write hashes to %s: %v", fn, err)
+		}
+		filenames = append(filenames, fn)
+	}
+	return filenames, nil
+}
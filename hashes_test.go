@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashFormats(t *testing.T) {
+	if h := hashcatHash(dataKey, dataSalt); h != "sha1:1000:iNciDA==:ioN63+yl6OFZ4/C7xl9VejMLDi0=" {
+		t.Error("Incorrect hashcat hash", h)
+	}
+	if h := johnHash(dataKey, dataSalt); h != "$pbkdf2-hmac-sha1$1000.88d7220c.8a837adfeca5e8e159e3f0bbc65f557a330b0e2d" {
+		t.Error("Incorrect john hash", h)
+	}
+}
+
+func TestExportHashes(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+
+	b := new(backups)
+	if err := b.loadBackups(tmpDir); err != nil {
+		t.Fatal("loadBackups failed", err)
+	}
+
+	fns, err := exportHashes(filepath.Join(tmpDir, "hashes"), b)
+	if err != nil {
+		t.Fatal("exportHashes failed", err)
+	}
+	if len(fns) != 2 {
+		t.Fatal("Incorrect file count", fns)
+	}
+	data, err := ioutil.ReadFile(fns[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two hashes, got %q", lines)
+	}
+	if !strings.HasPrefix(lines[0], "ios10backup:sha1:1000:") {
+		t.Errorf("First line not tagged with backup directory: %q", lines[0])
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// Outcomes reported to the -on-result command.
+const (
+	outcomeFound      = "found"       // the passcode was recovered
+	outcomeNotFound   = "not_found"   // passcode information was found, but not the passcode
+	outcomeNoPasscode = "no_passcode" // the backup doesn't hold a passcode
+	outcomeError      = "error"       // the backup couldn't be read; see status
+)
+
+// hookResult is the JSON document passed to the -on-result command on stdin.
+type hookResult struct {
+	Path             string    `json:"path"`
+	DeviceName       string    `json:"deviceName"`
+	ProductName      string    `json:"productName"`
+	ProductType      string    `json:"productType"`
+	ProductVersion   string    `json:"productVersion"`
+	UDID             string    `json:"udid"`
+	LastBackup       time.Time `json:"lastBackup"`
+	Encrypted        bool      `json:"encrypted"`
+	ScreenTime       bool      `json:"screenTime"`
+	Outcome          string    `json:"outcome"`
+	Status           string    `json:"status,omitempty"`
+	Passcode         string    `json:"passcode,omitempty"`
+	PasscodeRedacted bool      `json:"passcodeRedacted,omitempty"`
+	UnlockedBy       string    `json:"unlockedBy,omitempty"`
+	Cached           bool      `json:"cached"`
+}
+
+// newHookResult builds the result for b, omitting the passcode unless
+// includePasscode is true.
+func newHookResult(b *backup, includePasscode bool) hookResult {
+	r := hookResult{
+		Path:           b.Path,
+		DeviceName:     b.Info.DisplayName,
+		ProductName:    b.Info.ProductName,
+		ProductType:    b.Info.ProductType,
+		ProductVersion: b.Info.ProductVersion,
+		UDID:           b.Info.UniqueIdentifier,
+		LastBackup:     b.Info.LastBackup,
+		Encrypted:      b.isEncrypted(),
+		ScreenTime:     b.UsesScreenTime || b.isIOS12(),
+		Status:         b.Status,
+		UnlockedBy:     b.UnlockedBy,
+		Cached:         b.Cached,
+	}
+	switch {
+	case b.Passcode != "":
+		r.Outcome = outcomeFound
+		if includePasscode {
+			r.Passcode = b.Passcode
+		} else {
+			r.PasscodeRedacted = true
+		}
+	case b.Failed:
+		r.Outcome = outcomeNotFound
+	case b.Status == msgNoPasscode:
+		r.Outcome = outcomeNoPasscode
+	default:
+		r.Outcome = outcomeError
+	}
+	return r
+}
+
+// shellCommand returns a command that runs command using the system shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// runResultHook runs command with the result for b as JSON on stdin.  The
+// command's output is sent to stderr so that it doesn't mix with the report.
+func runResultHook(command string, timeout time.Duration, b *backup, includePasscode bool) error {
+	data, err := json.Marshal(newHookResult(b, includePasscode))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	killProcessGroup(cmd)
+	cmd.Stdin = bytes.NewReader(append(data, '\n'))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second // don't wait forever on output held open by a child process
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+// runResultHooks runs the -on-result command for each backup, reporting any
+// failures to stderr.  It returns false if any invocation failed.
+func runResultHooks(allBackups *backups) bool {
+	ok := true
+	for _, b := range allBackups.backups {
+		if err := runResultHook(*onResult, *onResultTimeout, b, *onResultPasscode); err != nil {
+			fmt.Fprintf(os.Stderr, "-on-result command failed for %s: %v\n", b.Path, err)
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResultHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a POSIX shell")
+	}
+	tmpDir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(tmpDir)
+	out := filepath.Join(tmpDir, "result.json")
+
+	b := &backup{Path: "/backups/one", Passcode: "1234"}
+	b.Info.DisplayName = "device one"
+	b.Manifest.IsEncrypted = true
+
+	for _, includePasscode := range []bool{false, true} {
+		if err := runResultHook("cat > "+out, time.Second, b, includePasscode); err != nil {
+			t.Fatal("Hook failed", err)
+		}
+		data, _ := ioutil.ReadFile(out)
+		var r hookResult
+		if err := json.Unmarshal(data, &r); err != nil {
+			t.Fatal("Invalid JSON", err)
+		}
+		if r.Outcome != outcomeFound || r.DeviceName != "device one" || !r.Encrypted {
+			t.Errorf("Incorrect result %#v", r)
+		}
+		if includePasscode && (r.Passcode != "1234" || r.PasscodeRedacted) {
+			t.Errorf("Passcode not included %#v", r)
+		}
+		if !includePasscode && (r.Passcode != "" || !r.PasscodeRedacted) {
+			t.Errorf("Passcode not redacted %#v", r)
+		}
+	}
+
+	if err := runResultHook("exit 3", time.Second, b, false); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Error("Expected exit status error, got", err)
+	}
+	start := time.Now()
+	if err := runResultHook("sleep 10", 100*time.Millisecond, b, false); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Error("Expected timeout error, got", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Timeout not enforced")
+	}
+}
+
+func TestHookOutcome(t *testing.T) {
+	tests := []struct {
+		b       backup
+		outcome string
+	}{
+		{backup{Passcode: "1234"}, outcomeFound},
+		{backup{Failed: true, Status: msgPINNotFound}, outcomeNotFound},
+		{backup{Status: msgNoPasscode}, outcomeNoPasscode},
+		{backup{Status: msgIncorrectPassword}, outcomeError},
+	}
+	for _, test := range tests {
+		if r := newHookResult(&test.b, false); r.Outcome != test.outcome {
+			t.Errorf("Expected outcome %q for %q, got %q", test.outcome, test.b.Status, r.Outcome)
+		}
+	}
+}
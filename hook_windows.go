@@ -0,0 +1,10 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import "os/exec"
+
+// killProcessGroup is a no-op on Windows, where only the shell itself is
+// killed if the command times out.
+func killProcessGroup(cmd *exec.Cmd) {}
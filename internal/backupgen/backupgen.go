@@ -0,0 +1,453 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+// Package backupgen generates synthetic iOS backups for testing.
+//
+// The generated backups follow the on-disk layout used by iTunes closely enough
+// to be read by pinfinder and the github.com/gwatts/ios libraries: unencrypted
+// backups hold a plain restrictions plist, while encrypted backups include a
+// password protected keybag, a Manifest.db (encrypted for iOS 10.2 and later,
+// or a Manifest.mbdb for iOS 9 and earlier) and encrypted copies of the restrictions plist or, for iOS 12 and
+// later, the keychain backup holding the Screen Time passcode.
+//
+// Key derivation uses a very low iteration count by default so that backups
+// can be decrypted quickly.
+package backupgen
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	plist "github.com/DHowett/go-plist"
+	"github.com/gwatts/ios/crypto/aeswrap"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	restrictionsDomain = "HomeDomain"
+	restrictionsPath   = "Library/Preferences/com.apple.restrictionspassword.plist"
+	keychainDomain     = "KeychainDomain"
+	keychainPath       = "keychain-backup.plist"
+
+	// protection class used for all generated files and the manifest
+	protectionClass = 3
+
+	defaultIterations = 10
+)
+
+// Options describes the backup to generate.
+type Options struct {
+	DeviceName     string
+	ProductType    string
+	ProductVersion string // iOS version; selects the backup layout
+	UDID           string // defaults to a random identifier
+	LastBackup     time.Time
+
+	// Password is the backup encryption password; the backup is not
+	// encrypted if it's empty.
+	Password string
+
+	// Passcode is the restrictions or Screen Time passcode to store; no
+	// passcode is stored if it's empty.
+	Passcode string
+
+	// Iterations sets the PBKDF2 iteration counts used to protect the keybag.
+	// iTunes uses 10,000,000 (iOS 10.2+); the default is 10.
+	Iterations int
+}
+
+// Preset is a named set of options covering one of the supported backup layouts.
+type Preset struct {
+	Name    string
+	Options Options
+}
+
+// Presets returns options for each backup layout pinfinder supports, using the
+// supplied encryption password and passcode.
+func Presets(password, passcode string) []Preset {
+	tm := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	return []Preset{
+		{"legacy plain (iOS 9)", Options{DeviceName: "iOS 9 plain", ProductVersion: "9.3.5", LastBackup: tm, Passcode: passcode}},
+		{"legacy plain (iOS 11)", Options{DeviceName: "iOS 11 plain", ProductVersion: "11.4", LastBackup: tm, Passcode: passcode}},
+		{"legacy encrypted (iOS 9)", Options{DeviceName: "iOS 9 encrypted", ProductVersion: "9.3.5", LastBackup: tm, Password: password, Passcode: passcode}},
+		{"legacy encrypted (iOS 10.0)", Options{DeviceName: "iOS 10.0 encrypted", ProductVersion: "10.0.2", LastBackup: tm, Password: password, Passcode: passcode}},
+		{"legacy encrypted (iOS 10.1)", Options{DeviceName: "iOS 10.1 encrypted", ProductVersion: "10.1.1", LastBackup: tm, Password: password, Passcode: passcode}},
+		{"legacy encrypted (iOS 11)", Options{DeviceName: "iOS 11 encrypted", ProductVersion: "11.4", LastBackup: tm, Password: password, Passcode: passcode}},
+		{"Screen Time encrypted (iOS 12)", Options{DeviceName: "iOS 12 encrypted", ProductVersion: "12.4", LastBackup: tm, Password: password, Passcode: passcode}},
+	}
+}
+
+func (o *Options) majorVersion() int {
+	maj, _ := strconv.Atoi(strings.Split(o.ProductVersion, ".")[0])
+	return maj
+}
+
+func (o *Options) minorVersion() int {
+	parts := strings.Split(o.ProductVersion, ".")
+	if len(parts) < 2 {
+		return 0
+	}
+	minor, _ := strconv.Atoi(parts[1])
+	return minor
+}
+
+// modern returns true for iOS 10.2 and later, which encrypt Manifest.db and
+// add a second round of key derivation to the keybag.
+func (o *Options) modern() bool {
+	maj := o.majorVersion()
+	return maj > 10 || (maj == 10 && o.minorVersion() >= 2)
+}
+
+// Generate writes a backup described by opts into dir, creating it if necessary.
+func Generate(dir string, opts Options) error {
+	if opts.ProductVersion == "" {
+		return fmt.Errorf("ProductVersion is required")
+	}
+	if opts.UDID == "" {
+		opts.UDID = hex.EncodeToString(randBytes(20))
+	}
+	if opts.ProductType == "" {
+		opts.ProductType = "iPhone10,1"
+	}
+	if opts.Iterations <= 0 {
+		opts.Iterations = defaultIterations
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	g := &generator{dir: dir, opts: opts}
+	if err := g.writeInfo(); err != nil {
+		return err
+	}
+	if opts.Password == "" {
+		return g.writePlain()
+	}
+	return g.writeEncrypted()
+}
+
+type generator struct {
+	dir    string
+	opts   Options
+	keybag *keybag
+}
+
+func (g *generator) writePlist(name string, v interface{}, format int) error {
+	data, err := plist.Marshal(v, format)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(g.dir, name), data, 0644)
+}
+
+func (g *generator) writeInfo() error {
+	return g.writePlist("Info.plist", map[string]interface{}{
+		"Last Backup Date":  g.opts.LastBackup,
+		"Display Name":      g.opts.DeviceName,
+		"Device Name":       g.opts.DeviceName,
+		"Product Name":      "iPhone",
+		"Product Type":      g.opts.ProductType,
+		"Product Version":   g.opts.ProductVersion,
+		"Unique Identifier": strings.ToUpper(g.opts.UDID),
+		"Target Identifier": strings.ToUpper(g.opts.UDID),
+	}, plist.XMLFormat)
+}
+
+// writeFile stores a backup file under its hashed name; iOS 10 and later
+// place files in sub-directories named after the first two characters of the hash.
+func (g *generator) writeFile(domain, relPath string, data []byte) error {
+	hash := FileID(domain, relPath)
+	fn := filepath.Join(g.dir, hash)
+	if g.opts.majorVersion() >= 10 {
+		fn = filepath.Join(g.dir, hash[:2], hash)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(fn, data, 0644)
+}
+
+// FileID returns the name a file is stored under in a backup.
+func FileID(domain, relPath string) string {
+	sum := sha1.Sum([]byte(domain + "-" + relPath))
+	return hex.EncodeToString(sum[:])
+}
+
+// RestrictionsPlist returns a restrictions plist storing passcode.
+func RestrictionsPlist(passcode string) []byte {
+	salt := randBytes(4)
+	key := pbkdf2.Key([]byte(passcode), salt, 1000, 20, sha1.New)
+	data, _ := plist.Marshal(map[string]interface{}{
+		"RestrictionsPasswordKey":  key,
+		"RestrictionsPasswordSalt": salt,
+	}, plist.XMLFormat)
+	return data
+}
+
+func (g *generator) writePlain() error {
+	if err := g.writePlist("Manifest.plist", map[string]interface{}{
+		"IsEncrypted": false,
+		"Version":     "10.0",
+	}, plist.XMLFormat); err != nil {
+		return err
+	}
+	if err := g.writeStatus(); err != nil {
+		return err
+	}
+	// iOS 12 and later store the Screen Time passcode only in the encrypted keychain
+	if g.opts.Passcode == "" || g.opts.majorVersion() >= 12 {
+		return nil
+	}
+	return g.writeFile(restrictionsDomain, restrictionsPath, RestrictionsPlist(g.opts.Passcode))
+}
+
+func (g *generator) statusVersion() string {
+	switch {
+	case g.opts.majorVersion() < 10:
+		return "2.4"
+	case g.opts.modern():
+		return "3.3"
+	}
+	return fmt.Sprintf("3.%d", g.opts.minorVersion())
+}
+
+func (g *generator) writeStatus() error {
+	return g.writePlist("Status.plist", map[string]interface{}{
+		"Version":       g.statusVersion(),
+		"SnapshotState": "finished",
+		"IsFullBackup":  false,
+		"BackupState":   "new",
+		"Date":          g.opts.LastBackup,
+		"UUID":          strings.ToUpper(hex.EncodeToString(randBytes(16))),
+	}, plist.XMLFormat)
+}
+
+// file is an entry to be recorded in the backup manifest.
+type file struct {
+	domain, path string
+	key          []byte // file encryption key
+	size         int
+}
+
+func (g *generator) writeEncrypted() error {
+	g.keybag = newKeybag(g.opts.Password, g.opts.Iterations, g.opts.modern())
+
+	var files []file
+	if g.opts.Passcode != "" {
+		var err error
+		var f file
+		if g.opts.majorVersion() >= 12 {
+			f, err = g.writeEncryptedFile(keychainDomain, keychainPath, keychainPlist(g.opts.Passcode, g.keybag))
+		} else {
+			f, err = g.writeEncryptedFile(restrictionsDomain, restrictionsPath, RestrictionsPlist(g.opts.Passcode))
+		}
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	manifest := map[string]interface{}{
+		"IsEncrypted":  true,
+		"Version":      "10.0",
+		"BackupKeyBag": g.keybag.encode(),
+		"Lockdown": map[string]interface{}{
+			"DeviceName":     g.opts.DeviceName,
+			"ProductVersion": g.opts.ProductVersion,
+			"ProductType":    g.opts.ProductType,
+		},
+	}
+
+	switch {
+	case g.opts.majorVersion() < 10:
+		if err := ioutil.WriteFile(filepath.Join(g.dir, "Manifest.mbdb"), manifestMBDB(files, g.keybag), 0644); err != nil {
+			return err
+		}
+	case g.opts.modern():
+		mkey := randBytes(32)
+		manifest["ManifestKey"] = append(le32(protectionClass), aeswrap.Wrap(g.keybag.classKey(protectionClass), mkey)...)
+		db, err := manifestDB(files, g.fileRecord, nil)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(g.dir, "Manifest.db"), encryptCBC(mkey, db), 0644); err != nil {
+			return err
+		}
+	default:
+		// iOS 10.0 and 10.1 leave Manifest.db unencrypted
+		record, props := g.fileRecord, map[string][]byte(nil)
+		if g.statusVersion() == "3.0" {
+			record, props = g.blobRecords()
+		}
+		db, err := manifestDB(files, record, props)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(g.dir, "Manifest.db"), db, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := g.writePlist("Manifest.plist", manifest, plist.XMLFormat); err != nil {
+		return err
+	}
+	return g.writeStatus()
+}
+
+func (g *generator) fileRecord(f file) ([]byte, error) {
+	return fileRecord(f, g.keybag)
+}
+
+// blobRecords returns the record encoder and properties for an iOS 10.0
+// manifest, which encrypts each file's metadata with a key derived from the
+// password and a salt kept in the Properties table, along with a hash used
+// to check the password.
+func (g *generator) blobRecords() (func(file) ([]byte, error), map[string][]byte) {
+	salt := randBytes(20)
+	pw := append([]byte(g.opts.Password), salt...)
+	hash := sha256.Sum256(pw)
+	blobKey := sha1.Sum(pw)
+	iv := make([]byte, aes.BlockSize)
+	for i := range iv {
+		iv[i] = byte(i)
+	}
+	record := func(f file) ([]byte, error) {
+		data, err := fileRecord(f, g.keybag)
+		if err != nil {
+			return nil, err
+		}
+		enc := encryptCBCIV(blobKey[:16], iv, data)
+		return []byte(base64.StdEncoding.EncodeToString(enc)), nil
+	}
+	return record, map[string][]byte{"salt": salt, "passwordHash": hash[:]}
+}
+
+// writeEncryptedFile encrypts data with a new file key and stores it in the backup.
+func (g *generator) writeEncryptedFile(domain, relPath string, data []byte) (file, error) {
+	key := randBytes(32)
+	f := file{domain: domain, path: relPath, key: key, size: len(data)}
+	return f, g.writeFile(domain, relPath, encryptCBC(key, data))
+}
+
+// wrappedKey returns a file key wrapped with its class key, prefixed with the
+// protection class as stored in the manifest.
+func (f file) wrappedKey(kb *keybag) []byte {
+	return append(le32(protectionClass), aeswrap.Wrap(kb.classKey(protectionClass), f.key)...)
+}
+
+// encryptCBC encrypts data using AES-CBC with a zero IV and PKCS7 padding.
+func encryptCBC(key, data []byte) []byte {
+	return encryptCBCIV(key, make([]byte, aes.BlockSize), data)
+}
+
+// encryptCBCIV encrypts data using AES-CBC with the given IV and PKCS7 padding.
+func encryptCBCIV(key, iv, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	out := append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+	return out
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// keybag holds the class keys for a backup, wrapped with a key derived from
+// the backup password.
+type keybag struct {
+	salt, auxSalt []byte
+	iter, auxIter int
+	classes       map[uint32][]byte
+	passkey       []byte
+}
+
+// newKeybag creates a keybag protected by password.  iOS 10.2 and later
+// backups add a second, SHA256 based, round of key derivation.
+func newKeybag(password string, iterations int, modern bool) *keybag {
+	kb := &keybag{
+		salt:    randBytes(20),
+		iter:    iterations,
+		classes: make(map[uint32][]byte),
+	}
+	passkey := []byte(password)
+	if modern {
+		kb.auxSalt = randBytes(20)
+		kb.auxIter = iterations
+		passkey = pbkdf2.Key(passkey, kb.auxSalt, kb.auxIter, 32, sha256.New)
+	}
+	kb.passkey = pbkdf2.Key(passkey, kb.salt, kb.iter, 32, sha1.New)
+	for class := uint32(1); class <= 11; class++ {
+		kb.classes[class] = randBytes(32)
+	}
+	return kb
+}
+
+func (kb *keybag) classKey(class uint32) []byte {
+	return kb.classes[class]
+}
+
+// encode serializes the keybag as the tagged binary structure stored in
+// Manifest.plist.
+func (kb *keybag) encode() []byte {
+	var buf bytes.Buffer
+	tag := func(name string, value []byte) {
+		buf.WriteString(name)
+		buf.Write(be32(uint32(len(value))))
+		buf.Write(value)
+	}
+	tag("VERS", be32(3))
+	tag("TYPE", be32(1)) // backup keybag
+	tag("UUID", randBytes(16))
+	tag("HMCK", randBytes(40))
+	tag("WRAP", be32(0))
+	tag("SALT", kb.salt)
+	tag("ITER", be32(uint32(kb.iter)))
+	if kb.auxIter > 0 {
+		tag("DPWT", be32(1))
+		tag("DPIC", be32(uint32(kb.auxIter)))
+		tag("DPSL", kb.auxSalt)
+	}
+	for class := uint32(1); class <= 11; class++ {
+		tag("UUID", randBytes(16))
+		tag("CLAS", be32(class))
+		tag("WRAP", be32(2)) // wrapped with the password derived key
+		tag("KTYP", be32(0))
+		tag("WPKY", aeswrap.Wrap(kb.passkey, kb.classes[class]))
+	}
+	return buf.Bytes()
+}
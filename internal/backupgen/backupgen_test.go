@@ -0,0 +1,72 @@
+package backupgen
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gwatts/ios/crypto/gcm"
+)
+
+func TestSealZeroIV(t *testing.T) {
+	key := randBytes(32)
+	for _, size := range []int{0, 5, 16, 37} {
+		plain := randBytes(size)
+		block, _ := aes.NewCipher(key)
+		g, _ := gcm.NewGCM(block)
+		out, err := g.Open(nil, nil, sealZeroIV(key, plain), nil)
+		if err != nil {
+			t.Errorf("size %d: open failed: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(out, plain) {
+			t.Errorf("size %d: incorrect plaintext", size)
+		}
+	}
+}
+
+func TestGenerateLayout(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "backupgen")
+	defer os.RemoveAll(tmpDir)
+
+	for i, p := range Presets("pw", "1234") {
+		dir := filepath.Join(tmpDir, string('a'+rune(i)))
+		if err := Generate(dir, p.Options); err != nil {
+			t.Fatalf("%s: Generate failed: %v", p.Name, err)
+		}
+		expected := []string{"Info.plist", "Manifest.plist", "Status.plist"}
+		if p.Options.Password != "" {
+			if p.Options.majorVersion() >= 10 {
+				expected = append(expected, "Manifest.db")
+			} else {
+				expected = append(expected, "Manifest.mbdb")
+			}
+		}
+		for _, fn := range expected {
+			if _, err := os.Stat(filepath.Join(dir, fn)); err != nil {
+				t.Errorf("%s: missing %s", p.Name, fn)
+			}
+		}
+	}
+}
+
+func TestStatusVersion(t *testing.T) {
+	tests := []struct {
+		productVersion, expected string
+	}{
+		{"9.3.5", "2.4"},
+		{"10.0.2", "3.0"},
+		{"10.1.1", "3.1"},
+		{"10.2", "3.3"},
+		{"12.4", "3.3"},
+	}
+	for _, test := range tests {
+		g := &generator{opts: Options{ProductVersion: test.productVersion}}
+		if actual := g.statusVersion(); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.productVersion, test.expected, actual)
+		}
+	}
+}
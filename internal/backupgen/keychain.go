@@ -0,0 +1,124 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package backupgen
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/asn1"
+	"time"
+
+	plist "github.com/DHowett/go-plist"
+	"github.com/gwatts/ios/crypto/aeswrap"
+)
+
+// keychainPlist returns a keychain-backup.plist holding a single Screen Time
+// passcode entry, encrypted using the keybag's class keys.
+func keychainPlist(passcode string, kb *keybag) []byte {
+	attrs := []asn1.RawValue{
+		keychainAttr("svce", "ParentalControls"),
+		keychainAttr("acct", "ParentalControls"),
+		keychainAttr("agrp", "com.apple.ScreenTimeAgent"),
+		keychainAttr("mdat", time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)),
+		keychainAttr("v_Data", []byte(passcode)),
+	}
+	var body []byte
+	for _, attr := range attrs {
+		body = append(body, attr.FullBytes...)
+	}
+	record, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: body})
+	if err != nil {
+		panic(err)
+	}
+
+	itemKey := randBytes(32)
+	wrapped := aeswrap.Wrap(kb.classKey(protectionClass), itemKey)
+	blob := append(le32(3), le32(protectionClass)...) // blob version, protection class
+	blob = append(blob, le32(uint32(len(wrapped)))...)
+	blob = append(blob, wrapped...)
+	blob = append(blob, sealZeroIV(itemKey, record)...)
+
+	data, err := plist.Marshal(map[string]interface{}{
+		"genp": []interface{}{map[string]interface{}{
+			"v_Data":          blob,
+			"v_PersistentRef": randBytes(12),
+		}},
+		"inet": []interface{}{},
+		"cert": []interface{}{},
+		"keys": []interface{}{},
+	}, plist.BinaryFormat)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// keychainAttr encodes a single keychain attribute as an ASN.1 SEQUENCE of its
+// name and value.
+func keychainAttr(name string, value interface{}) asn1.RawValue {
+	var data []byte
+	var err error
+	switch v := value.(type) {
+	case string:
+		data, err = asn1.Marshal(struct {
+			Key   string `asn1:"utf8"`
+			Value string `asn1:"utf8"`
+		}{name, v})
+	case time.Time:
+		data, err = asn1.Marshal(struct {
+			Key   string    `asn1:"utf8"`
+			Value time.Time `asn1:"generalized"`
+		}{name, v})
+	case []byte:
+		data, err = asn1.Marshal(struct {
+			Key   string `asn1:"utf8"`
+			Value []byte
+		}{name, v})
+	}
+	if err != nil {
+		panic(err)
+	}
+	return asn1.RawValue{FullBytes: data}
+}
+
+// sealZeroIV encrypts plain with AES-GCM using the all-zero initial counter
+// block that iOS uses for keychain backup items.
+//
+// The standard library only supports 96 bit nonces, which start the counter
+// at one, so the keystream is generated separately and the standard GCM
+// implementation is only used to compute the GHASH of the ciphertext.
+func sealZeroIV(key, plain []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	counter := func(n byte) []byte {
+		c := make([]byte, aes.BlockSize)
+		c[aes.BlockSize-1] = n
+		return c
+	}
+
+	// With a zero initial block, encryption starts at counter 1.
+	ciphertext := make([]byte, len(plain))
+	cipher.NewCTR(block, counter(1)).XORKeyStream(ciphertext, plain)
+
+	// A standard GCM seal with a zero nonce encrypts from counter 2 and masks
+	// the tag with E(counter 1); feed it input that encrypts to our ciphertext
+	// and swap the tag mask for E(counter 0).
+	input := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, counter(2)).XORKeyStream(input, ciphertext)
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	tag := gcm.Seal(nil, make([]byte, gcm.NonceSize()), input, nil)[len(input):]
+
+	var mask0, mask1 [aes.BlockSize]byte
+	block.Encrypt(mask0[:], counter(0))
+	block.Encrypt(mask1[:], counter(1))
+	for i := range tag {
+		tag[i] ^= mask0[i] ^ mask1[i]
+	}
+	return append(ciphertext, tag...)
+}
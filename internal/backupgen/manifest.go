@@ -0,0 +1,146 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package backupgen
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+
+	plist "github.com/DHowett/go-plist"
+	_ "github.com/mattn/go-sqlite3" // sqlite driver for Manifest.db
+)
+
+// manifestDB builds the sqlite manifest used by iOS 10 and later backups.
+// record encodes the metadata stored with each file and properties are
+// stored in the Properties table.
+func manifestDB(files []file, record func(file) ([]byte, error), properties map[string][]byte) ([]byte, error) {
+	tmp, err := ioutil.TempFile("", "backupgen-manifest")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	db, err := sql.Open("sqlite3", tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	stmts := []string{
+		"CREATE TABLE Files (fileID TEXT PRIMARY KEY, domain TEXT, relativePath TEXT, flags INTEGER, file BLOB)",
+		"CREATE INDEX FilesDomainIdx ON Files(domain)",
+		"CREATE INDEX FilesRelativePathIdx ON Files(relativePath)",
+		"CREATE INDEX FilesFlagsIdx ON Files(flags)",
+		"CREATE TABLE Properties (key TEXT PRIMARY KEY, value BLOB)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range files {
+		blob, err := record(f)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec("INSERT INTO Files VALUES (?, ?, ?, 1, ?)",
+			FileID(f.domain, f.path), f.domain, f.path, blob); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range properties {
+		if _, err := db.Exec("INSERT INTO Properties VALUES (?, ?)", key, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(tmp.Name())
+}
+
+// fileRecord returns the NSKeyedArchiver encoded MBFile metadata stored with
+// each row of Manifest.db.
+func fileRecord(f file, kb *keybag) ([]byte, error) {
+	archive := map[string]interface{}{
+		"$archiver": "NSKeyedArchiver",
+		"$version":  int64(100000),
+		"$top":      map[string]interface{}{"root": plist.UID(1)},
+		"$objects": []interface{}{
+			"$null",
+			map[string]interface{}{
+				"$class":           plist.UID(5),
+				"EncryptionKey":    plist.UID(2),
+				"RelativePath":     plist.UID(4),
+				"ProtectionClass":  int64(protectionClass),
+				"Size":             int64(f.size),
+				"Mode":             int64(0100644),
+				"UserID":           int64(501),
+				"GroupID":          int64(501),
+				"Birth":            int64(1546300800),
+				"LastModified":     int64(1546300800),
+				"LastStatusChange": int64(1546300800),
+				"InodeNumber":      int64(12345),
+				"Flags":            int64(0),
+			},
+			map[string]interface{}{
+				"$class":  plist.UID(3),
+				"NS.data": f.wrappedKey(kb),
+			},
+			map[string]interface{}{
+				"$classname": "NSMutableData",
+				"$classes":   []interface{}{"NSMutableData", "NSData", "NSObject"},
+			},
+			f.path,
+			map[string]interface{}{
+				"$classname": "MBFile",
+				"$classes":   []interface{}{"MBFile", "NSObject"},
+			},
+		},
+	}
+	return plist.Marshal(archive, plist.BinaryFormat)
+}
+
+// manifestMBDB builds the binary manifest used by iOS 9 and earlier backups.
+func manifestMBDB(files []file, kb *keybag) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("mbdb\x05\x00")
+	str := func(b []byte) {
+		if b == nil {
+			binary.Write(&buf, binary.BigEndian, uint16(0xffff))
+			return
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(b)))
+		buf.Write(b)
+	}
+	for _, f := range files {
+		str([]byte(f.domain))
+		str([]byte(f.path))
+		str(nil) // link target
+		str(nil) // digest
+		str(f.wrappedKey(kb))
+		binary.Write(&buf, binary.BigEndian, struct {
+			Mode          uint16
+			Inode         uint64
+			UID, GID      uint32
+			Mtime, Atime  uint32
+			Ctime         uint32
+			Length        uint64
+			ProtClass     uint8
+			PropertyCount uint8
+		}{
+			Mode:      0100644,
+			Inode:     12345,
+			UID:       501,
+			GID:       501,
+			Length:    uint64(f.size),
+			ProtClass: protectionClass,
+		})
+	}
+	return buf.Bytes()
+}
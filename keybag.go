@@ -0,0 +1,96 @@
+// +build !nodecrypt
+
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/gwatts/ios/keybag"
+)
+
+var (
+	// tags understood by keybag.Read; it exits the program if it finds any other.
+	keybagHeaderTags = []string{"VERS", "TYPE", "WRAP", "HMCK", "SALT", "ITER", "DPWT", "DPIC", "DPSL", "UUID"}
+	keybagKeyTags    = []string{"UUID", "CLAS", "WRAP", "KTYP", "WPKY"}
+)
+
+// maxWrappedKey is the largest input aeswrap.Unwrap handles without panicking.
+const maxWrappedKey = 43 * 8
+
+// readKeybag checks that data is a well formed keybag before parsing it with
+// keybag.Read, which doesn't handle corrupt data gracefully.
+func readKeybag(data []byte) (keybag.Keybag, error) {
+	uuids := 0
+	for pos := 0; pos+8 < len(data); {
+		tag := string(data[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		pos += 8
+		if size > len(data)-pos {
+			return keybag.Keybag{}, fmt.Errorf("keybag entry %q is truncated", tag)
+		}
+		if tag == "UUID" {
+			uuids++
+		}
+		allowed := keybagHeaderTags
+		if uuids > 1 {
+			// the second UUID starts the list of class keys
+			allowed = keybagKeyTags
+		}
+		if !oneOf(tag, allowed) {
+			return keybag.Keybag{}, fmt.Errorf("unexpected keybag entry %q", tag)
+		}
+		if tag == "WPKY" && !validWrappedKey(data[pos:pos+size]) {
+			return keybag.Keybag{}, errors.New("invalid wrapped key in keybag")
+		}
+		pos += size
+	}
+
+	kb := keybag.Read(data)
+	if len(kb.Keys) == 0 {
+		return kb, errors.New("backup keybag is missing or empty")
+	}
+	return kb, nil
+}
+
+// validWrappedKey returns true if key can safely be passed to aeswrap.Unwrap.
+func validWrappedKey(key []byte) bool {
+	return len(key)%8 == 0 && len(key) <= maxWrappedKey
+}
+
+// describeEncryption returns the encryption parameters of the backup held by src.
+func describeEncryption(src backupSource) *encryptionDiag {
+	var manifest struct {
+		BackupKeyBag []byte
+		ManifestKey  []byte
+	}
+	if err := parsePlist(src.fsys, "Manifest.plist", &manifest); err != nil {
+		return &encryptionDiag{Error: err.Error()}
+	}
+	kb, err := readKeybag(manifest.BackupKeyBag)
+	if err != nil {
+		return &encryptionDiag{Error: err.Error()}
+	}
+	d := &encryptionDiag{
+		KeybagVersion:              kb.Version,
+		KeybagType:                 kb.Type,
+		KeybagUUID:                 hex.EncodeToString(kb.UUID),
+		Wrap:                       kb.Wrap,
+		Iterations:                 kb.Iter,
+		DoubleProtectionIterations: kb.AuxIter,
+		Classes:                    []uint32{},
+	}
+	for _, k := range kb.Keys {
+		d.Classes = append(d.Classes, k.Class)
+	}
+	if len(manifest.ManifestKey) >= 4 {
+		class := binary.LittleEndian.Uint32(manifest.ManifestKey)
+		d.ManifestKeyClass = &class
+	}
+	return d
+}
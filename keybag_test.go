@@ -0,0 +1,37 @@
+// +build !nodecrypt
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReadKeybagCorrupt(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":       nil,
+		"truncated":   []byte("VERS\x00\x00\x01\x07\x00\x00\x00\x03"),
+		"unknown tag": []byte("VERS\x00\x00\x00\x04\x00\x00\x00\x03ABCD\x00\x00\x00\x01x"),
+		"long key": append([]byte("UUID\x00\x00\x00\x00UUID\x00\x00\x00\x00CLAS\x00\x00\x00\x04\x00\x00\x00\x01WPKY\x00\x00\x01\x60"),
+			bytes.Repeat([]byte{0}, 0x160)...),
+	}
+	for name, data := range tests {
+		if _, err := readKeybag(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDecryptBadKeybag(t *testing.T) {
+	withPasswords(t, &passwordSource{candidates: []candidate{{"x", "test"}}})
+
+	b := &backup{src: backupSource{fsys: fstest.MapFS{
+		"Manifest.plist": {Data: mkManifest(true)},
+		"Status.plist":   {Data: []byte(statusData)},
+	}}}
+	decrypt(b)
+	if b.Status == "" || b.UnlockedBy != "" {
+		t.Errorf("Unexpected result status=%q unlockedBy=%q", b.Status, b.UnlockedBy)
+	}
+}
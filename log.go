@@ -0,0 +1,125 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logger receives progress and diagnostic messages.  They're written to stderr,
+// or the -log-file, so that the report on stdout isn't interrupted.
+var logger = slog.New(newConsoleHandler(os.Stderr, slog.LevelInfo))
+
+// configureLogging sets up logger from the -v, -log-level and -log-file flags.
+func configureLogging() {
+	level, err := parseLogLevel(*logLevel, *verbose)
+	if err != nil {
+		exit(102, true, err.Error())
+	}
+	if *logFile == "" {
+		logger = slog.New(newConsoleHandler(os.Stderr, level))
+		return
+	}
+	f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		exit(102, false, "Failed to open log file: %v", err)
+	}
+	cleanups = append(cleanups, func() { f.Close() })
+	logger = slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{Level: level}))
+}
+
+// parseLogLevel returns the level named by s; verbose selects debug.
+func parseLogLevel(s string, verbose bool) (slog.Level, error) {
+	if verbose {
+		return slog.LevelDebug, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("-log-level must be one of debug, info, warn or error")
+	}
+	return level, nil
+}
+
+// consoleHandler writes log records for people reading a terminal: just the
+// message, prefixed with the level unless it's info, followed by any
+// attributes as key=value pairs.
+type consoleHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	attrs  string // pre-formatted attributes from WithAttrs
+	prefix string // group prefix for attribute keys
+}
+
+func newConsoleHandler(w io.Writer, level slog.Leveler) *consoleHandler {
+	return &consoleHandler{mu: new(sync.Mutex), w: w, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if r.Level != slog.LevelInfo {
+		buf.WriteString(r.Level.String() + ": ")
+	}
+	buf.WriteString(r.Message)
+	buf.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.prefix, a)
+		return true
+	})
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	for _, a := range attrs {
+		appendAttr(&buf, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs += buf.String()
+	return &h2
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+func appendAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(buf, prefix, ga)
+		}
+		return
+	}
+	v := a.Value.String()
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		v = strconv.Quote(v)
+	}
+	fmt.Fprintf(buf, " %s%s=%s", prefix, a.Key, v)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestConsoleHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(newConsoleHandler(&buf, slog.LevelInfo))
+	l.Debug("hidden")
+	l.Info("scanning backups", "dir", "/some dir", "count", 2)
+	l.With("backup", "b1").WithGroup("g").Warn("search failed", "error", errors.New("bad"))
+
+	expected := `scanning backups dir="/some dir" count=2
+WARN: search failed backup=b1 g.error=bad
+`
+	if buf.String() != expected {
+		t.Errorf("incorrect output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		s       string
+		verbose bool
+		level   slog.Level
+		ok      bool
+	}{
+		{"info", false, slog.LevelInfo, true},
+		{"WARN", false, slog.LevelWarn, true},
+		{"error", true, slog.LevelDebug, true},
+		{"loud", false, 0, false},
+	}
+	for _, test := range tests {
+		level, err := parseLogLevel(test.s, test.verbose)
+		if (err == nil) != test.ok || level != test.level {
+			t.Errorf("%q verbose=%t: got %s, %v", test.s, test.verbose, level, err)
+		}
+	}
+}
+
+func TestTraceLogging(t *testing.T) {
+	var buf bytes.Buffer
+	saved := logger
+	logger = slog.New(newConsoleHandler(&buf, slog.LevelDebug))
+	defer func() { logger = saved }()
+
+	b := &backup{Path: "b1"}
+	b.note("extract", "reading %s", "plist")
+	b.noteErr("search", errors.New("not found"))
+	if len(b.trace) != 2 {
+		t.Fatalf("expected 2 trace steps, got %d", len(b.trace))
+	}
+	expected := `DEBUG: reading plist backup=b1 step=extract
+WARN: search failed backup=b1 error="not found"
+`
+	if buf.String() != expected {
+		t.Errorf("incorrect output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
@@ -0,0 +1,256 @@
+// +build !nodecrypt
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+
+	iosbackup "github.com/gwatts/ios/backup"
+	"github.com/gwatts/ios/crypto/aeswrap"
+	"github.com/gwatts/ios/kvarchive"
+)
+
+var errRecordNotFound = errors.New("record not found")
+
+// loadRecords makes the records for the given file IDs in backup b available
+// to encbw without loading the rest of the manifest.
+//
+// iOS 10.2 and later backups store the manifest in an encrypted sqlite
+// database; it's decrypted to a temporary file and only the requested rows
+// are read from it.  Older backups fall back to loading the full manifest.
+//
+// If the backup is held in an archive, the files for the records are copied
+// into encbw's directory so that the ios library can read them.
+func loadRecords(b *backup, encbw *iosbackup.MobileBackup, ids ...string) error {
+	var err error
+	if encbw.Version < iosbackup.BackupVersioniOS102 || encbw.Manifest.ManifestKey == nil {
+		err = loadAllRecords(b, encbw)
+	} else {
+		err = queryRecords(b, encbw, ids)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, rec := range encbw.Records {
+		if !oneOf(rec.Id, ids) {
+			continue
+		}
+		if encbw.Version == iosbackup.BackupVersioniOS10 && rec.ProtClass == 0 {
+			r, err := decryptBlobRecord(encbw, rec)
+			if err != nil {
+				return err
+			}
+			encbw.Records[i], rec = *r, *r
+		}
+		if len(rec.Key) < 4 || !validWrappedKey(rec.Key[4:]) {
+			return fmt.Errorf("record %s has an invalid encryption key", rec.Id)
+		}
+		if b.src.dir != "" {
+			continue
+		}
+		hc := rec.HashCode()
+		if err := stageFile(b.src.fsys, hc, encbw.Dir); err != nil {
+			// iOS 10 and later store files in sub-folders
+			if err := stageFile(b.src.fsys, path.Join(hc[:2], hc), encbw.Dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadAllRecords loads the full manifest of a pre-iOS 10.2 backup.
+func loadAllRecords(b *backup, encbw *iosbackup.MobileBackup) error {
+	// iOS 10.0 manifests are staged by openBackup
+	if b.src.dir == "" && encbw.Version != iosbackup.BackupVersioniOS10 {
+		manifest := "Manifest.db"
+		if encbw.Version < iosbackup.BackupVersioniOS10 {
+			manifest = "Manifest.mbdb"
+		}
+		if err := stageFile(b.src.fsys, manifest, encbw.Dir); err != nil {
+			return err
+		}
+	}
+	if err := encbw.Load(); err != nil {
+		return err
+	}
+	for i, rec := range encbw.Records {
+		// Records read from a Manifest.mbdb don't include their ID
+		if rec.Id == "" {
+			encbw.Records[i].Id = rec.HashCode()
+		}
+	}
+	return nil
+}
+
+// decryptBlobRecord decodes the metadata of a record read from an iOS 10.0
+// manifest, which is encrypted with a key derived from the backup password.
+// The ios library would exit if the metadata were corrupt, so it's decoded here.
+func decryptBlobRecord(encbw *iosbackup.MobileBackup, rec iosbackup.Record) (*iosbackup.Record, error) {
+	if len(encbw.BlobKey) != 16 || len(rec.Key) == 0 || len(rec.Key)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("record %s has invalid metadata", rec.Id)
+	}
+	block, err := aes.NewCipher(encbw.BlobKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	for i := range iv {
+		iv[i] = byte(i)
+	}
+	data := make([]byte, len(rec.Key))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, rec.Key)
+	pad := int(data[len(data)-1])
+	if pad < 1 || pad > aes.BlockSize || !bytes.Equal(data[len(data)-pad:], bytes.Repeat(data[len(data)-1:], pad)) {
+		return nil, fmt.Errorf("record %s has invalid metadata", rec.Id)
+	}
+	return parseFileRecord(rec.Id, rec.Domain, data[:len(data)-pad])
+}
+
+// queryRecords reads just the records for ids from an iOS 10.2+ manifest database.
+func queryRecords(b *backup, encbw *iosbackup.MobileBackup, ids []string) error {
+	dbfn, err := decryptManifestDB(b.src.fsys, encbw)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dbfn)
+
+	db, err := sql.Open("sqlite3", dbfn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	b.manifestDB = describeManifestDB(db, true)
+
+	encbw.Records = nil
+	for _, id := range ids {
+		rec, err := queryRecord(db, id)
+		if err == errRecordNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		encbw.Records = append(encbw.Records, *rec)
+	}
+	return nil
+}
+
+// decryptManifestDB decrypts Manifest.db from fsys to a temporary file, returning
+// its name.  The caller is responsible for removing the file.
+func decryptManifestDB(fsys fs.FS, encbw *iosbackup.MobileBackup) (string, error) {
+	mk := encbw.Manifest.ManifestKey
+	if len(mk) < 4 || !validWrappedKey(mk[4:]) {
+		return "", errors.New("invalid manifest key")
+	}
+	class := binary.LittleEndian.Uint32(mk)
+	ckey := encbw.Keybag.GetClassKey(class)
+	if ckey == nil {
+		return "", fmt.Errorf("no manifest key for class %d", class)
+	}
+	key := aeswrap.Unwrap(ckey, mk[4:])
+	if key == nil {
+		return "", errors.New("failed to unwrap manifest key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	in, err := fsys.Open("Manifest.db")
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile("", "pinfinder-manifest")
+	if err != nil {
+		return "", err
+	}
+	if err := decryptCBC(out, in, block); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", fmt.Errorf("failed to decrypt Manifest.db: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// decryptCBC streams r through an AES-CBC decrypter with a zero IV into w.
+// Any padding is left in place; sqlite ignores trailing data.
+func decryptCBC(w io.Writer, r io.Reader, block cipher.Block) error {
+	cbc := cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize))
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n%aes.BlockSize != 0 {
+			return errors.New("data is not a multiple of the block size")
+		}
+		if n > 0 {
+			cbc.CryptBlocks(buf[:n], buf[:n])
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// queryRecord reads a single file record from a decrypted manifest database.
+func queryRecord(db *sql.DB, id string) (*iosbackup.Record, error) {
+	var domain string
+	var data []byte
+	err := db.QueryRow("SELECT domain, file FROM files WHERE fileID = ?", id).Scan(&domain, &data)
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query manifest for %s: %v", id, err)
+	}
+	return parseFileRecord(id, domain, data)
+}
+
+// parseFileRecord decodes the archived file metadata stored with each manifest row.
+func parseFileRecord(id, domain string, data []byte) (*iosbackup.Record, error) {
+	obj, err := kvarchive.UnArchive(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode record %s: %v", id, err)
+	}
+	frec, ok := obj.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected record type for %s", id)
+	}
+	rec := &iosbackup.Record{Id: id, Domain: domain}
+	rec.Key, _ = frec["EncryptionKey"].([]byte)
+	rec.Path, _ = frec["RelativePath"].(string)
+	class, ok := frec["ProtectionClass"].(int64)
+	if !ok || len(rec.Key) < 4 || !validWrappedKey(rec.Key[4:]) {
+		return nil, fmt.Errorf("record %s has no encryption key", id)
+	}
+	rec.ProtClass = uint8(class)
+	if size, ok := frec["Size"].(int64); ok {
+		rec.Length = uint64(size)
+	}
+	return rec, nil
+}
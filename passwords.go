@@ -0,0 +1,183 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/howeyc/gopass"
+)
+
+const (
+	unlockedByPrompt = "password entered at prompt"
+	unlockedByKey    = "backup key"
+)
+
+var (
+	errNoPassword  = errors.New(msgIsEncrypted)
+	errBadPassword = errors.New(msgIncorrectPassword)
+)
+
+// passwords supplies encryption passwords to decrypt.
+var passwords = &passwordSource{attempts: 3, prompt: promptPassword}
+
+type candidate struct {
+	password string
+	label    string // describes where the password came from, without revealing it
+}
+
+// passwordSource tracks candidate passwords for encrypted backups.
+//
+// Passwords that have unlocked a backup are tried first for later backups,
+// followed by any supplied with -passwords and finally the user is prompted
+// up to attempts times.  It's safe for concurrent use; prompts are serialized.
+type passwordSource struct {
+	mu         sync.Mutex  // guards known
+	promptMu   sync.Mutex  // held by the backup currently prompting the user; guards prompted
+	known      []candidate // passwords that have unlocked at least one backup
+	candidates []candidate // passwords supplied with -passwords
+	attempts   int
+	prompted   bool
+	prompt     func(b *backup, attempt, attempts int) string
+}
+
+// loadCandidates reads candidate passwords from fn, one per line.
+func (ps *passwordSource) loadCandidates(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("failed to open password file: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		pw := strings.TrimRight(s.Text(), "\r")
+		if pw == "" {
+			continue
+		}
+		ps.candidates = append(ps.candidates, candidate{pw, fmt.Sprintf("password file line %d", line)})
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("failed to read password file: %v", err)
+	}
+	return nil
+}
+
+// remember records a password that successfully unlocked a backup.
+func (ps *passwordSource) remember(c candidate) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, k := range ps.known {
+		if k.password == c.password {
+			return
+		}
+	}
+	ps.known = append(ps.known, c)
+}
+
+// unlock calls try with each candidate password for b until one succeeds,
+// returning a description of the password that worked.
+//
+// try should return errBadPassword if the password is incorrect; any other
+// error aborts the attempt and is returned to the caller.  If no password
+// could be obtained errNoPassword is returned.
+func (ps *passwordSource) unlock(b *backup, try func(pw string) error) (string, error) {
+	tried := make(map[string]bool)
+	result := errNoPassword
+
+	ps.mu.Lock()
+	cands := append(append([]candidate(nil), ps.known...), ps.candidates...)
+	ps.mu.Unlock()
+	if label, err := ps.tryCandidates(cands, tried, try, &result); label != "" || err != nil {
+		return label, err
+	}
+
+	if ps.attempts < 1 {
+		return "", result
+	}
+
+	// Only one backup prompts at a time; once it's our turn, first try any
+	// passwords that unlocked other backups while we were waiting.
+	ps.promptMu.Lock()
+	defer ps.promptMu.Unlock()
+
+	ps.mu.Lock()
+	cands = append([]candidate(nil), ps.known...)
+	ps.mu.Unlock()
+	if label, err := ps.tryCandidates(cands, tried, try, &result); label != "" || err != nil {
+		return label, err
+	}
+
+	for attempt := 1; attempt <= ps.attempts; attempt++ {
+		pw := ps.ask(b, attempt)
+		if pw == "" {
+			break
+		}
+		switch err := try(pw); err {
+		case nil:
+			ps.remember(candidate{pw, unlockedByPrompt})
+			return unlockedByPrompt, nil
+		case errBadPassword:
+			result = errBadPassword
+			if attempt < ps.attempts {
+				fmt.Fprintf(os.Stderr, "Incorrect password; %d attempts remaining\n", ps.attempts-attempt)
+			}
+		default:
+			return "", err
+		}
+	}
+	return "", result
+}
+
+// tryCandidates calls try with each candidate that hasn't already been tried,
+// returning the label of the one that succeeded.  result is set to errBadPassword
+// if any candidate was rejected.
+func (ps *passwordSource) tryCandidates(cands []candidate, tried map[string]bool, try func(pw string) error, result *error) (string, error) {
+	for _, c := range cands {
+		if tried[c.password] {
+			continue
+		}
+		tried[c.password] = true
+		switch err := try(c.password); err {
+		case nil:
+			ps.remember(c)
+			return c.label, nil
+		case errBadPassword:
+			*result = errBadPassword
+		default:
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// ask prompts for a password; the caller must hold promptMu.
+func (ps *passwordSource) ask(b *backup, attempt int) string {
+	if !ps.prompted {
+		ps.prompted = true
+		fmt.Fprintln(os.Stderr, "\nSome backups are encrypted; passcode recovery requires the")
+		fmt.Fprintln(os.Stderr, "encryption password used with iTunes.  Press return to skip a backup.")
+	}
+	return ps.prompt(b, attempt, ps.attempts)
+}
+
+// promptPassword asks the user for the encryption password for a backup.
+func promptPassword(b *backup, attempt, attempts int) string {
+	fmt.Fprintf(os.Stderr, "\nEnter iTunes Encryption Password for %s", b.Info.DisplayName)
+	if attempt > 1 {
+		fmt.Fprintf(os.Stderr, " (attempt %d of %d)", attempt, attempts)
+	}
+	fmt.Fprint(os.Stderr, ": ")
+	pw, _ := gopass.GetPasswdMasked()
+	fmt.Fprintln(os.Stderr)
+	if len(pw) > 0 {
+		fmt.Fprintln(os.Stderr, "Decryption may take a few minutes...")
+	}
+	return string(pw)
+}
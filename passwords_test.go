@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withPasswords replaces the password source for the duration of a test.
+func withPasswords(t *testing.T, ps *passwordSource) {
+	saved := passwords
+	passwords = ps
+	t.Cleanup(func() { passwords = saved })
+}
+
+func checkPassword(want string) func(string) error {
+	return func(pw string) error {
+		if pw == want {
+			return nil
+		}
+		return errBadPassword
+	}
+}
+
+func TestPasswordCandidates(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(tmpDir)
+	fn := filepath.Join(tmpDir, "passwords.txt")
+	ioutil.WriteFile(fn, []byte("one\r\n\ntwo\nthree\n"), 0600)
+
+	var prompts int
+	ps := &passwordSource{attempts: 2, prompt: func(b *backup, attempt, attempts int) string {
+		prompts++
+		return "typed"
+	}}
+	if err := ps.loadCandidates(fn); err != nil {
+		t.Fatal("loadCandidates failed", err)
+	}
+
+	by, err := ps.unlock(new(backup), checkPassword("two"))
+	if err != nil || by != "password file line 3" {
+		t.Errorf("Incorrect unlock result by=%q err=%v", by, err)
+	}
+
+	var tried []string
+	ps.unlock(new(backup), func(pw string) error {
+		tried = append(tried, pw)
+		return errBadPassword
+	})
+	if len(tried) != 5 || tried[0] != "two" {
+		t.Errorf("Known password not tried first, or wrong attempt count: %q", tried)
+	}
+	if prompts != 2 {
+		t.Errorf("Expected 2 prompts, got %d", prompts)
+	}
+
+	by, err = ps.unlock(new(backup), checkPassword("typed"))
+	if err != nil || by != unlockedByPrompt {
+		t.Errorf("Incorrect unlock result by=%q err=%v", by, err)
+	}
+}
+
+func TestPasswordNone(t *testing.T) {
+	ps := &passwordSource{attempts: 3, prompt: func(b *backup, attempt, attempts int) string { return "" }}
+	if _, err := ps.unlock(new(backup), checkPassword("x")); err != errNoPassword {
+		t.Error("Expected errNoPassword, got", err)
+	}
+
+	openErr := errors.New("open failed")
+	ps.candidates = []candidate{{"x", "test"}}
+	if _, err := ps.unlock(new(backup), func(string) error { return openErr }); err != openErr {
+		t.Error("Expected open error, got", err)
+	}
+}
@@ -41,11 +41,13 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"os"
 	"os/user"
 	"path"
@@ -55,11 +57,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"filippo.io/age"
 	"github.com/DHowett/go-plist"
-	"github.com/gwatts/ios/keychain"
 	"github.com/howeyc/gopass"
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -68,6 +71,7 @@ const (
 	maxPIN                = 10000
 	version               = "1.7.1"
 	restrictionsPlistName = "398bc9c2aeeab4cb0c12ada0f52eea12cf14f40b"
+	keychainRecordID      = "51a4616e576dd33cd2abadfea874eb8ff246bf0e" // KeychainDomain-keychain-backup.plist
 
 	msgIsEncrypted        = "backup is encrypted"
 	msgEncryptionDisabled = "encrypted backups not supported"
@@ -76,12 +80,38 @@ const (
 	msgNoPassword         = "need encryption password"
 	msgKeychainLoadFailed = "failed to read keychain"
 	msgEncryptedNeeded    = "need encrypted backup"
+	msgPINNotFound        = "Failed to find passcode"
 )
 
 var (
-	noPause     = flag.Bool("nopause", false, "Set to true to prevent the program pausing for input on completion")
-	showLicense = flag.Bool("license", false, "Display license information")
-	diag        = flag.Bool("diag", false, "Generate a diagnostic pinfinder-debug.zip file")
+	noPause          = flag.Bool("nopause", false, "Set to true to prevent the program pausing for input on completion")
+	showLicense      = flag.Bool("license", false, "Display license information")
+	diag             = flag.Bool("diag", false, "Generate a diagnostic pinfinder-debug.zip file")
+	diagRedact       = flag.String("diag-redact", redactNone, "Redaction `level` for the -diag report: none, metadata-only or strict")
+	diagDir          = flag.String("diag-dir", "", "Write the -diag report to `directory` instead of the program's directory, home directory or Desktop")
+	diagEncrypt      = flag.Bool("diag-encrypt", false, "Encrypt the -diag report to the public keys embedded at build time with -ldflags -X main.diagKeys; fails if none were")
+	diagKey          = flag.String("diag-key", "", "Encrypt the -diag report to these comma separated public `keys` or key files")
+	failureReport    = flag.Bool("failure-report", true, "Write a redacted pinfinder-failure.zip to attach to a bug report if a passcode can't be recovered unexpectedly")
+	exportTo         = flag.String("export-hashes", "", "Write restrictions hashes in hashcat and John the Ripper formats to `prefix`.hashcat and prefix.john")
+	useCache         = flag.Bool("cache", false, "Cache results so that unchanged backups aren't processed again on the next run")
+	cacheFile        = flag.String("cache-file", defaultCacheFile(), "Location of the result cache")
+	keyFlag          = flag.String("backup-key", "", "Hex encoded backup key from the derive-key command; skips password derivation for iOS 10.2+ backups")
+	pwFile           = flag.String("passwords", "", "Try each backup encryption password in `file` (one per line) before prompting")
+	workers          = flag.Int("workers", defaultWorkers(), "Maximum number of backups to decrypt or search concurrently")
+	pwAttempts       = flag.Int("password-attempts", 3, "Number of times to prompt for each encrypted backup's password; 0 disables prompting")
+	encCache         = flag.Bool("encrypt-cache", false, "Encrypt the result cache with a password (or set $PINFINDER_CACHE_PASSWORD)")
+	eventsFile       = flag.String("events", "", "Write progress events to `file` as newline delimited JSON")
+	watchInterval    = flag.Duration("interval", 5*time.Second, "How often the watch command checks for new or updated backups")
+	onResult         = flag.String("on-result", "", "Run `command` for each backup with its result as JSON on stdin")
+	onResultTimeout  = flag.Duration("on-result-timeout", 30*time.Second, "Time limit for each -on-result command")
+	onResultPasscode = flag.Bool("on-result-passcode", false, "Include the recovered passcode in the -on-result JSON; it's redacted by default")
+	verbose          = flag.Bool("v", false, "Log debugging messages; the same as -log-level debug")
+	logLevel         = flag.String("log-level", "info", "Minimum `level` of messages to log: debug, info, warn or error")
+	logFile          = flag.String("log-file", "", "Append log messages to `file` as JSON instead of writing them to stderr")
+	reportFormat     = flag.String("format", "text", "Report `format`: text, html or markdown")
+	templateFile     = flag.String("template", "", "Write the report using the text/template in `file` instead of -format")
+	outFile          = flag.String("o", "", "Write the report to `file` instead of standard output")
+	listenAddr       = flag.String("listen", "127.0.0.1:8484", "Loopback `address` for the serve command to listen on")
 )
 
 func isDir(p string) bool {
@@ -92,12 +122,12 @@ func isDir(p string) bool {
 	return s.IsDir()
 }
 
-func dumpFile(fn string) {
-	if f, err := os.Open(fn); err != nil {
-		fmt.Printf("Failed to open %s: %s\n", fn, err)
+func dumpFile(w io.Writer, fsys fs.FS, fn string) {
+	if f, err := fsys.Open(fn); err != nil {
+		fmt.Fprintf(w, "Failed to open %s: %s\n", fn, err)
 	} else {
 		defer f.Close()
-		io.Copy(os.Stdout, f)
+		io.Copy(w, f)
 	}
 }
 
@@ -110,7 +140,19 @@ func appendIfDir(dirs []string, dir string) []string {
 
 // figure out where iTunes keeps its backups on the current OS
 func findSyncDirs() (dirs []string, err error) {
+	candidates, err := candidateSyncDirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range candidates {
+		dirs = appendIfDir(dirs, dir)
+	}
+	return dirs, nil
+}
 
+// candidateSyncDirs returns the directories iTunes may keep backups in on the
+// current OS, whether or not they exist.
+func candidateSyncDirs() (dirs []string, err error) {
 	usr, err := user.Current()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get information about current user: %s", err)
@@ -118,16 +160,13 @@ func findSyncDirs() (dirs []string, err error) {
 
 	switch runtime.GOOS {
 	case "darwin":
-		dir := filepath.Join(usr.HomeDir, "Library", "Application Support", "MobileSync", "Backup")
-		dirs = appendIfDir(dirs, dir)
+		dirs = append(dirs, filepath.Join(usr.HomeDir, "Library", "Application Support", "MobileSync", "Backup"))
 
 	case "windows":
 		// this seems to be correct for all versions of Windows.. Tested on XP and Windows 8
-		dir := filepath.Join(os.Getenv("APPDATA"), "Apple Computer", "MobileSync", "Backup")
-		dirs = appendIfDir(dirs, dir)
-
-		dir = filepath.Join(os.Getenv("USERPROFILE"), "Apple", "MobileSync", "Backup")
-		dirs = appendIfDir(dirs, dir)
+		dirs = append(dirs,
+			filepath.Join(os.Getenv("APPDATA"), "Apple Computer", "MobileSync", "Backup"),
+			filepath.Join(os.Getenv("USERPROFILE"), "Apple", "MobileSync", "Backup"))
 
 	default:
 		return nil, errors.New("could not detect backup directory for this operating system; pass explicitly")
@@ -135,17 +174,17 @@ func findSyncDirs() (dirs []string, err error) {
 	return dirs, nil
 }
 
-func parsePlist(fn string, target interface{}) error {
-	f, err := os.Open(fn)
+func parsePlist(fsys fs.FS, fn string, target interface{}) error {
+	data, err := fs.ReadFile(fsys, fn)
 	if err != nil {
 		return err
 	}
 
-	return plist.NewDecoder(f).Decode(target)
+	return plist.NewDecoder(bytes.NewReader(data)).Decode(target)
 }
 
-func fileExists(fn string) bool {
-	fi, err := os.Stat(fn)
+func fileExists(fsys fs.FS, fn string) bool {
+	fi, err := fs.Stat(fsys, fn)
 	if err != nil {
 		return false
 	}
@@ -172,13 +211,22 @@ type backup struct {
 	Path             string
 	Status           string
 	RestrictionsPath string
+	restrictionsFile string // name of the restrictions plist within src
+	src              backupSource
 	UsesScreenTime   bool
+	Passcode         string // recovered passcode, if any
+	Failed           bool   // true if a restrictions hash was found, but not the passcode
+	Cached           bool   // true if the result was loaded from the result cache
+	UnlockedBy       string // describes the password or key that decrypted the backup
+	searched         bool   // set once findPasscode has run
+	failureReport    string // failure report written for the backup, if any
 	Info             struct {
-		LastBackup     time.Time `plist:"Last Backup Date"`
-		DisplayName    string    `plist:"Display Name"`
-		ProductName    string    `plist:"Product Name"`
-		ProductType    string    `plist:"Product Type"`
-		ProductVersion string    `plist:"Product Version"`
+		LastBackup       time.Time `plist:"Last Backup Date"`
+		DisplayName      string    `plist:"Display Name"`
+		ProductName      string    `plist:"Product Name"`
+		ProductType      string    `plist:"Product Type"`
+		ProductVersion   string    `plist:"Product Version"`
+		UniqueIdentifier string    `plist:"Unique Identifier"`
 	}
 	Manifest struct {
 		IsEncrypted interface{} `plist:"IsEncrypted"`
@@ -187,7 +235,10 @@ type backup struct {
 		Key  []byte `plist:"RestrictionsPasswordKey"`
 		Salt []byte `plist:"RestrictionsPasswordSalt"`
 	}
-	Keychain *keychain.Keychain
+	Keychain        keychainLookup
+	KeychainEntries []keychainEntry // Screen Time entries found in the keychain; the first was used
+	trace           []traceStep     // decisions and errors recorded for diagnostic reports
+	manifestDB      *manifestDBDiag // schema of the decrypted Manifest.db, if it was read
 }
 
 func (b *backup) debugInfo() string {
@@ -215,6 +266,59 @@ func (b *backup) isIOS12() bool {
 	return majorVersion(b.Info.ProductVersion) >= 12
 }
 
+// findPasscode attempts to recover the passcode for the backup, storing
+// the result in Passcode or the reason it couldn't be found in Status.
+func (b *backup) findPasscode() {
+	if b.searched {
+		return
+	}
+	b.searched = true
+	defer func() { events.emit(resultEvent(b)) }()
+
+	if b.Passcode != "" || b.Failed {
+		return // result loaded from the cache
+	}
+	switch {
+	case b.UsesScreenTime:
+		if b.Keychain == nil {
+			return // Status holds the reason the keychain was not loaded
+		}
+		entries, err := findPINFromKeychain(b.Keychain)
+		if err != nil {
+			b.Status = err.Error()
+			b.noteErr("keychain search", err)
+			return
+		}
+		b.Passcode = entries[0].Passcode
+		b.KeychainEntries = entries
+		b.note("keychain search", "found %d Screen Time passcode entries; using %s", len(entries), entries[0])
+
+	case len(b.Restrictions.Key) > 0:
+		events.emit(event{Type: eventSearchStarted, Path: b.Path, Total: maxPIN})
+		b.note("search", "trying passcodes 0000-%04d against a %d byte key and %d byte salt", maxPIN-1, len(b.Restrictions.Key), len(b.Restrictions.Salt))
+		start := time.Now()
+		defer b.noteTime("search", start)
+		pin, err := findPINProgress(b.Restrictions.Key, b.Restrictions.Salt, func(tried int) {
+			events.emit(event{Type: eventSearchProgress, Path: b.Path, Tried: tried, Total: maxPIN})
+		})
+		if err != nil {
+			b.Status = msgPINNotFound
+			b.Failed = true
+			b.noteErr("search", err)
+			return
+		}
+		b.Passcode = pin
+	}
+}
+
+// result returns the passcode or the status message to report for the backup.
+func (b *backup) result() string {
+	if b.Passcode != "" {
+		return b.Passcode
+	}
+	return b.Status
+}
+
 type backups struct {
 	encrypted bool
 	backups   []*backup
@@ -226,33 +330,61 @@ func (b backups) Less(i, j int) bool {
 }
 func (b backups) Swap(i, j int) { b.backups[i], b.backups[j] = b.backups[j], b.backups[i] }
 
-func (b *backups) loadBackups(syncDir string) error {
-	// loop over all directories and see whether they contain an Info.plist
+// findPasscodes attempts to recover the passcode for each backup in turn.
+func (b *backups) findPasscodes() {
+	for _, backup := range b.backups {
+		backup.findPasscode()
+	}
+}
+
+// discoverBackups returns a source for each directory in syncDir that may
+// hold a backup, in name order.
+func discoverBackups(syncDir string) ([]backupSource, error) {
 	d, err := os.Open(syncDir)
 	if err != nil {
 		if err := isBadMacPerms(err); err != nil {
-			return err
+			return nil, err
 		}
-		return fmt.Errorf("failed to open directory %q: %s", syncDir, err)
+		return nil, fmt.Errorf("failed to open directory %q: %s", syncDir, err)
 	}
 	defer d.Close()
 	fl, err := d.Readdir(-1)
 	if err != nil {
-		return fmt.Errorf("failed to read directory %q: %s", syncDir, err)
+		return nil, fmt.Errorf("failed to read directory %q: %s", syncDir, err)
 	}
+	var dirs []string
 	for _, fi := range fl {
-		if !fi.Mode().IsDir() {
-			continue
+		if fi.Mode().IsDir() {
+			dirs = append(dirs, filepath.Join(syncDir, fi.Name()))
 		}
-		path := filepath.Join(syncDir, fi.Name())
-		if backup, _ := loadBackup(path); backup != nil {
-			b.backups = append(b.backups, backup)
-			if backup.isEncrypted() {
-				b.encrypted = true
-			}
+	}
+	sort.Strings(dirs)
+	sources := make([]backupSource, len(dirs))
+	for i, dir := range dirs {
+		sources[i] = dirSource(dir)
+	}
+	return sources, nil
+}
+
+// add appends loaded backups, keeping the list sorted newest first.
+func (b *backups) add(loaded []*backup) {
+	for _, backup := range loaded {
+		b.backups = append(b.backups, backup)
+		if backup.isEncrypted() {
+			b.encrypted = true
 		}
 	}
-	sort.Sort(sort.Reverse(b))
+	sort.Stable(sort.Reverse(b))
+}
+
+func (b *backups) loadBackups(syncDir string) error {
+	// loop over all directories and see whether they contain an Info.plist
+	dirs, err := discoverBackups(syncDir)
+	if err != nil {
+		return err
+	}
+	logger.Debug("scanning sync directory", "dir", syncDir, "candidates", len(dirs))
+	b.add(processBackups(dirs, false))
 	return nil
 }
 
@@ -268,70 +400,93 @@ func majorVersion(v string) int {
 	return maj
 }
 
+// loadBackup loads the backup in backupDir and extracts its passcode information.
 func loadBackup(backupDir string) (*backup, error) {
+	b, err := loadBackupInfo(dirSource(backupDir))
+	if err != nil {
+		logger.Debug("not a backup", "dir", backupDir, "error", err)
+		return nil, err
+	}
+	events.emit(discoveredEvent(b))
+	b.extract()
+	return b, nil
+}
+
+// loadBackupInfo reads the metadata for the backup held by src, returning an
+// error if it doesn't hold a backup.
+func loadBackupInfo(src backupSource) (*backup, error) {
 	var b backup
 
-	if err := parsePlist(filepath.Join(backupDir, "Info.plist"), &b.Info); err != nil {
+	if err := parsePlist(src.fsys, "Info.plist", &b.Info); err != nil {
 		return nil, err // no Info.plist == invalid backup dir
 	}
 
-	if err := parsePlist(filepath.Join(backupDir, "Manifest.plist"), &b.Manifest); err != nil {
+	if err := parsePlist(src.fsys, "Manifest.plist", &b.Manifest); err != nil {
 		return nil, err // no Manifest.plist == invaild backup dir
 	}
 
-	b.Path = backupDir
+	b.Path = src.path
+	b.src = src
+	logger.Debug("found backup", "backup", b.Path, "device", b.Info.DisplayName, "ios", b.Info.ProductVersion, "encrypted", b.isEncrypted())
+	b.note("load", "iOS %s backup (%s), encrypted: %t", b.Info.ProductVersion, b.Info.ProductType, b.isEncrypted())
+
+	if resultCache != nil {
+		resultCache.apply(&b)
+	}
+	return &b, nil
+}
+
+// extract locates the passcode information in the backup, decrypting it if required.
+func (b *backup) extract() {
+	if b.Cached {
+		b.note("extract", "skipped; result loaded from the result cache")
+		return
+	}
+	start := time.Now()
+	defer b.noteTime("extract", start)
 
 	switch {
 	case b.isIOS12():
 		if !b.isEncrypted() {
+			b.note("extract", "iOS 12 and later store the Screen Time passcode in the keychain, which is only backed up when encrypted")
 			b.Status = msgEncryptedNeeded
-			return &b, nil
+			return
 		}
-		decrypt(backupDir, &b)
+		b.note("extract", "decrypting the keychain to read the Screen Time passcode")
+		decrypt(b)
 
 	default:
-		b.RestrictionsPath = filepath.Join(backupDir, restrictionsPlistName)
-		if _, err := os.Stat(b.RestrictionsPath); err != nil {
+		b.restrictionsFile = restrictionsPlistName
+		if _, err := fs.Stat(b.src.fsys, b.restrictionsFile); err != nil {
 			// iOS 10 moved backup files into sub-folders beginning with
 			// the first 2 letters of the filename.
-			b.RestrictionsPath = filepath.Join(backupDir, restrictionsPlistName[:2], restrictionsPlistName)
+			b.restrictionsFile = path.Join(restrictionsPlistName[:2], restrictionsPlistName)
+		}
+		b.RestrictionsPath = path.Join(filepath.ToSlash(b.Path), b.restrictionsFile)
+		if b.src.dir != "" {
+			b.RestrictionsPath = filepath.Join(b.src.dir, filepath.FromSlash(b.restrictionsFile))
 		}
 
-		if !fileExists(b.RestrictionsPath) {
+		if !fileExists(b.src.fsys, b.restrictionsFile) {
+			b.note("extract", "no restrictions plist found; the device has no passcode set")
 			b.Status = msgNoPasscode
-			return &b, nil
+			return
 		}
 		if b.isEncrypted() {
-			decrypt(backupDir, &b)
-			return &b, nil
+			b.note("extract", "decrypting the restrictions plist at %s", b.restrictionsFile)
+			decrypt(b)
+			return
 		}
-		if err := parsePlist(b.RestrictionsPath, &b.Restrictions); err != nil {
+		b.note("extract", "reading the restrictions plist at %s", b.restrictionsFile)
+		if err := parsePlist(b.src.fsys, b.restrictionsFile, &b.Restrictions); err != nil {
 			b.Status = err.Error()
+			b.noteErr("extract", err)
 		}
 	}
-
-	return &b, nil
 }
 
-var prompted bool
-var cachepw string
-
-func getpw() string {
-	if prompted {
-		return cachepw
-	}
-	prompted = true
-	fmt.Println("\nSome backups are encrypted; passcode recovery requires the")
-	fmt.Println("encryption password used with iTunes.  Press return to skip.")
-	fmt.Print("\nEnter iTunes Encryption Password: ")
-	pw, _ := gopass.GetPasswdMasked()
-	fmt.Println("")
-	cachepw = string(pw)
-	if cachepw != "" {
-		fmt.Println("Decryption may take a few minutes...")
-	}
-	return cachepw
-}
+// backupKey holds the pre-derived keybag key supplied with -backup-key, if any.
+var backupKey []byte
 
 type swg struct{ sync.WaitGroup }
 
@@ -346,7 +501,22 @@ func (wg *swg) WaitChan() chan struct{} {
 
 // use all available cores to brute force the PIN
 func findPIN(key, salt []byte) (string, error) {
-	found := make(chan string)
+	return findPINProgress(key, salt, nil)
+}
+
+// searchProgressInterval is the number of guesses between calls to a findPINProgress callback.
+const searchProgressInterval = 500
+
+// findPINProgress is findPIN, calling progress, if not nil, with the number of
+// guesses made so far as the search proceeds.
+func findPINProgress(key, salt []byte, progress func(tried int)) (pin string, err error) {
+	logger.Debug("searching for passcode", "candidates", maxPIN, "keyLength", len(key), "saltLength", len(salt), "threads", runtime.NumCPU())
+	defer func(start time.Time) {
+		logger.Debug("passcode search finished", "found", err == nil, "elapsed", time.Since(start))
+	}(time.Now())
+
+	found := make(chan string, runtime.NumCPU())
+	var tried int64
 	var wg swg
 	var start, end int
 
@@ -363,11 +533,14 @@ func findPIN(key, salt []byte) (string, error) {
 		go func(start, end int) {
 			for j := start; j < end; j++ {
 				guess := fmt.Sprintf("%04d", j)
-				k := pbkdf2.Key([]byte(guess), salt, 1000, len(key), sha1.New)
+				k := pbkdf2.Key([]byte(guess), salt, restrictionsIterations, len(key), sha1.New)
 				if bytes.Equal(k, key) {
 					found <- guess
 					return
 				}
+				if progress != nil && (j-start+1)%searchProgressInterval == 0 {
+					progress(int(atomic.AddInt64(&tried, searchProgressInterval)))
+				}
 			}
 			wg.Done()
 		}(start, end)
@@ -383,19 +556,13 @@ func findPIN(key, salt []byte) (string, error) {
 	}
 }
 
-func findPINFromKeychain(b *backup) (string, error) {
-	items := b.Keychain.General.FindByKeyMatch(keychain.KService, "ParentalControls")
-	if len(items) == 0 {
-		return "", fmt.Errorf("none")
-	}
-	code, ok := items[0][keychain.KData].([]byte)
-	if !ok {
-		return "", fmt.Errorf(msgNoPasscode)
-	}
-	return string(code), nil
-}
+// cleanups are run by exit before the program terminates.
+var cleanups []func()
 
 func exit(status int, addUsage bool, errfmt string, a ...interface{}) {
+	for _, f := range cleanups {
+		f()
+	}
 	if errfmt != "" {
 		fmt.Fprintf(os.Stderr, errfmt+"\n", a...)
 	}
@@ -403,7 +570,7 @@ func exit(status int, addUsage bool, errfmt string, a ...interface{}) {
 		usage()
 	}
 	if !*noPause {
-		fmt.Printf("Press Enter to exit")
+		fmt.Fprint(os.Stderr, "Press Enter to exit")
 		bufio.NewReader(os.Stdin).ReadBytes('\n')
 	}
 	os.Exit(status)
@@ -430,10 +597,149 @@ func exitBadMacPerms() {
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "Usage:", path.Base(os.Args[0]), " [flags] [<path to latest iTunes backup directory>]")
+	fmt.Fprintln(os.Stderr, "Usage:", path.Base(os.Args[0]), " [flags] [<path to latest iTunes backup directory or archive>]")
+	fmt.Fprintln(os.Stderr, "      ", path.Base(os.Args[0]), " [flags] <command> [args]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commandNames() {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", cmd, commands[cmd].help)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
 	flag.PrintDefaults()
 }
 
+// command is a sub-command that's run in place of the normal backup scan.
+type command struct {
+	help string
+	run  func(args []string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"cache":       {"list|clear - List or clear the result cache", runCache},
+		"doctor":      {"[sync dir...] - Check the sync directories and backups for problems", runDoctor},
+		"diag-keygen": {"[secret key file] - Create a key pair for encrypted diagnostic reports", runDiagKeygen},
+		"diag-replay": {"<pinfinder-debug.zip> - Rerun the passcode search on the backups in a diagnostic report", runDiagReplay},
+		"diag-open":   {"<bundle> <secret key file> [output] - Decrypt an encrypted diagnostic report", runDiagOpen},
+		"derive-key":  {"<backup dir> - Print the key derived from an encrypted backup's password for use with -backup-key", runDeriveKey},
+		"watch":       {"[sync dir...] - Process backups as they're created or updated", runWatch},
+		"serve":       {"[sync dir...] - Run a web interface and JSON API on the -listen address", runServe},
+		"selftest":    {"- Check this build by recovering passcodes from generated backups", runSelftest},
+	}
+}
+
+func commandNames() (names []string) {
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseCommandFlags parses any flags that follow a command's arguments, returning
+// the remaining arguments.
+func parseCommandFlags(args []string) []string {
+	var rest []string
+	for len(args) > 0 {
+		flag.CommandLine.Parse(args)
+		args = flag.Args()
+		if len(args) > 0 {
+			rest = append(rest, args[0])
+			args = args[1:]
+		}
+	}
+	configureLogging()
+	return rest
+}
+
+// openResultCache opens the result cache, prompting for a password if required.
+func openResultCache() *cache {
+	var pw string
+	if *encCache {
+		pw = getCachePassword()
+	}
+	c, err := openCache(*cacheFile, pw)
+	if err == errCacheEncrypted {
+		c, err = openCache(*cacheFile, getCachePassword())
+	}
+	if err != nil {
+		exit(112, false, err.Error())
+	}
+	return c
+}
+
+func runCache(args []string) {
+	args = parseCommandFlags(args)
+	if len(args) != 1 {
+		exit(102, true, "cache requires one of list or clear")
+	}
+	switch args[0] {
+	case "list":
+		openResultCache().list(os.Stdout)
+	case "clear":
+		if err := clearCache(*cacheFile); err != nil {
+			exit(112, false, err.Error())
+		}
+		fmt.Println("Cleared result cache", *cacheFile)
+	default:
+		exit(102, true, "Unknown cache command %q", args[0])
+	}
+	exit(0, false, "")
+}
+
+func runDeriveKey(args []string) {
+	args = parseCommandFlags(args)
+	if len(args) != 1 {
+		exit(102, true, "derive-key requires a backup directory")
+	}
+	fmt.Fprint(os.Stderr, "Enter iTunes Encryption Password: ")
+	pw, _ := gopass.GetPasswdMasked()
+	fmt.Fprintln(os.Stderr, "Deriving key; this may take a few minutes...")
+	key, err := deriveKey(args[0], string(pw))
+	if err != nil {
+		exit(113, false, err.Error())
+	}
+	fmt.Println("\nBackup key:", key)
+	fmt.Println("\nThe key unlocks this backup in place of its password; keep it safe.")
+	fmt.Printf("Use it with: %s -backup-key %s %s\n\n", path.Base(os.Args[0]), key, args[0])
+	exit(0, false, "")
+}
+
+// applyFlags configures the password source, backup key and result cache
+// from the command line flags.
+func applyFlags() {
+	passwords.attempts = *pwAttempts
+	if *pwFile != "" {
+		if err := passwords.loadCandidates(*pwFile); err != nil {
+			exit(102, false, err.Error())
+		}
+	}
+
+	if *keyFlag != "" {
+		key, err := hex.DecodeString(*keyFlag)
+		if err != nil || len(key) != 32 {
+			exit(102, true, "-backup-key must be a 64 character hex string from the derive-key command")
+		}
+		backupKey = key
+	}
+
+	if *useCache || *encCache {
+		resultCache = openResultCache()
+	}
+
+	if *eventsFile != "" {
+		// events get a file of their own, as prompts, log messages and
+		// -on-result output all share stderr
+		f, err := os.Create(*eventsFile)
+		if err != nil {
+			exit(102, false, "Failed to open events file: %v", err)
+		}
+		cleanups = append(cleanups, func() { f.Close() })
+		events.subscribe(jsonEventWriter(f))
+	}
+}
+
 func init() {
 	flag.Usage = usage
 }
@@ -470,28 +776,39 @@ func generateReport(f io.Writer, includeDirName bool, allBackups *backups) {
 			info.ProductVersion,
 			info.LastBackup.In(time.Local).Format("Jan _2, 2006 03:04 PM MST"))
 
-		if b.UsesScreenTime {
-			pin, err := findPINFromKeychain(b)
-			if err != nil {
-				fmt.Fprintln(f, err.Error())
-			} else {
-				fmt.Fprintln(f, pin)
-			}
-
-		} else if len(b.Restrictions.Key) > 0 {
-			pin, err := findPIN(b.Restrictions.Key, b.Restrictions.Salt)
-			if err != nil {
-				fmt.Fprintln(f, "Failed to find passcode")
-				failed = append(failed, b)
-			} else {
-				fmt.Fprintln(f, pin)
-			}
-		} else {
-			fmt.Fprintln(f, b.Status)
+		fmt.Fprintln(f, b.result())
+		if b.Failed {
+			failed = append(failed, b)
 		}
 	}
 
 	fmt.Fprintln(f)
+
+	var unlocked []*backup
+	for _, b := range allBackups.backups {
+		if b.UnlockedBy != "" {
+			unlocked = append(unlocked, b)
+		}
+	}
+	if len(unlocked) > 0 {
+		fmt.Fprintln(f, "Encrypted backups unlocked with:")
+		for _, b := range unlocked {
+			fmt.Fprintf(f, "  %-35.35s  %-40s  %s\n", b.Info.DisplayName, filepath.Base(b.Path), b.UnlockedBy)
+		}
+		fmt.Fprintln(f)
+	}
+
+	for _, b := range allBackups.backups {
+		if len(b.KeychainEntries) == 0 {
+			continue
+		}
+		fmt.Fprintf(f, "Screen Time passcode for %s taken from keychain %s\n", b.Info.DisplayName, b.KeychainEntries[0])
+		for _, e := range b.KeychainEntries[1:] {
+			fmt.Fprintf(f, "  Alternative passcode %s from keychain %s\n", e.Passcode, e)
+		}
+		fmt.Fprintln(f)
+	}
+
 	for _, b := range failed {
 		fmt.Fprintf(f, "Failed to find PIN for backup %s\nPlease file a bug report at https://github.com/gwatts/pinfinder/issues\n", b.Path)
 		fmt.Fprintf(f, "%-20s: %s\n", "Product Name", b.Info.ProductName)
@@ -500,16 +817,18 @@ func generateReport(f io.Writer, includeDirName bool, allBackups *backups) {
 		fmt.Fprintf(f, "%-20s: %s\n", "Salt", base64.StdEncoding.EncodeToString(b.Restrictions.Salt))
 		fmt.Fprintf(f, "%-20s: %s\n", "Key", base64.StdEncoding.EncodeToString(b.Restrictions.Key))
 
-		dumpFile(b.RestrictionsPath)
+		if b.restrictionsFile != "" {
+			dumpFile(f, b.src.fsys, b.restrictionsFile)
+		}
 		fmt.Fprintln(f, "")
 	}
 }
 
 func donate() {
-	fmt.Println("| DID PINFINDER SAVE THE DAY?")
-	fmt.Println("| Please consider donating a few dollars to say thanks!")
-	fmt.Println("| https://pinfinder.net/donate")
-	fmt.Println("")
+	fmt.Fprintln(os.Stderr, "| DID PINFINDER SAVE THE DAY?")
+	fmt.Fprintln(os.Stderr, "| Please consider donating a few dollars to say thanks!")
+	fmt.Fprintln(os.Stderr, "| https://pinfinder.net/donate")
+	fmt.Fprintln(os.Stderr)
 }
 
 var syncDir string
@@ -517,10 +836,10 @@ var syncDir string
 func main() {
 	allBackups := new(backups)
 
-	fmt.Println("PIN Finder", version)
-	fmt.Println("iOS Restrictions Passcode Finder")
-	fmt.Println("https://pinfinder.net")
-	fmt.Println()
+	fmt.Fprintln(os.Stderr, "PIN Finder", version)
+	fmt.Fprintln(os.Stderr, "iOS Restrictions Passcode Finder")
+	fmt.Fprintln(os.Stderr, "https://pinfinder.net")
+	fmt.Fprintln(os.Stderr)
 
 	flag.Parse()
 
@@ -530,28 +849,62 @@ func main() {
 	}
 
 	args := flag.Args()
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			cmd.run(args[1:])
+			return
+		}
+	}
+
+	configureLogging()
+	applyFlags()
+	if *diag && !oneOf(*diagRedact, redactionLevels) {
+		exit(102, true, "-diag-redact must be one of %s", strings.Join(redactionLevels, ", "))
+	}
+	applyReportFlags()
+	var recipients []age.Recipient
+	if *diag {
+		var err error
+		if recipients, err = diagRecipients(); err != nil {
+			exit(102, true, err.Error())
+		}
+	}
+
 	switch len(args) {
 	case 0:
 		syncDirs, err := findSyncDirs()
 		if err != nil {
 			exit(101, true, err.Error())
 		}
-		fmt.Println("Sync Directories:", syncDirs)
-		fmt.Println("Scanning backups...")
+		logger.Info("scanning backups", "syncDirs", syncDirs)
 
+		var dirs []backupSource
 		for _, syncDir := range syncDirs {
-			if err := allBackups.loadBackups(syncDir); err != nil {
-				if isBadMacPerms(err); err != nil {
+			found, err := discoverBackups(syncDir)
+			if err != nil {
+				if isBadMacPerms(err) != nil {
 					exitBadMacPerms()
 				}
 				exit(101, true, err.Error())
 			}
+			dirs = append(dirs, found...)
 		}
+		allBackups.add(processBackups(dirs, true))
 
 	case 1:
+		if isArchive(args[0]) {
+			logger.Info("scanning archive", "file", args[0])
+			sources, cleanup, err := openArchive(args[0])
+			if err != nil {
+				exit(101, false, err.Error())
+			}
+			cleanups = append(cleanups, cleanup)
+			allBackups.add(processBackups(sources, true))
+			break
+		}
 		b, err := loadBackup(args[0])
 		if err != nil {
-			if isBadMacPerms(err); err != nil {
+			if isBadMacPerms(err) != nil {
 				exitBadMacPerms()
 			}
 			exit(101, true, "Invalid backup directory")
@@ -562,21 +915,62 @@ func main() {
 		exit(102, true, "Too many arguments")
 	}
 
-	fmt.Println()
+	fmt.Fprintln(os.Stderr)
+
+	allBackups.findPasscodes()
+
+	if resultCache != nil {
+		var cached int
+		for _, b := range allBackups.backups {
+			if b.Cached {
+				cached++
+			}
+		}
+		if cached > 0 {
+			logger.Info("loaded results from the cache", "count", cached, "cache", *cacheFile)
+		}
+		if err := resultCache.storeAll(allBackups); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to update result cache:", err)
+		}
+	}
+
+	if *exportTo != "" {
+		fns, err := exportHashes(*exportTo, allBackups)
+		if err != nil {
+			exit(111, false, err.Error())
+		}
+		logger.Info("exported restrictions hashes", "files", strings.Join(fns, ", "))
+	}
+
+	hooksOK := true
+	if *onResult != "" {
+		hooksOK = runResultHooks(allBackups)
+	}
 
 	if *diag {
-		var buf bytes.Buffer
-		fmt.Println("Generating backup diagnostic report; may take a couple of minutes..")
-		generateReport(io.MultiWriter(os.Stdout, &buf), true, allBackups)
-		if fn, err := buildDebug("", buf.String(), allBackups); err != nil {
+		logger.Info("generating backup diagnostic report; may take a couple of minutes")
+		if err := writeReport(allBackups); err != nil {
+			exit(119, false, err.Error())
+		}
+		fn, err := buildDebug(*diagDir, *diagRedact, allBackups, recipients)
+		if err != nil {
 			exit(110, false, err.Error())
-		} else {
-			fmt.Println("Generated diagnostic report file stored at", fn)
-			exit(0, false, "")
 		}
+		if recipients != nil {
+			logger.Info("the diagnostic report is encrypted and can only be read by the holders of its keys")
+		}
+		logger.Info("generated diagnostic report", "file", fn)
+		exit(0, false, "")
 	}
 
-	generateReport(os.Stdout, false, allBackups)
+	// write any failure report first, so the report can refer to it
+	reportFailures(allBackups)
+	if err := writeReport(allBackups); err != nil {
+		exit(119, false, err.Error())
+	}
 	donate()
+	if !hooksOK {
+		exit(115, false, "One or more -on-result commands failed")
+	}
 	exit(0, false, "")
 }
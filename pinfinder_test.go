@@ -7,6 +7,8 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
 )
 
 const pinData = `<?xml version="1.0" encoding="UTF-8"?>
@@ -32,6 +34,23 @@ var (
 	dataPIN  = "1234"
 )
 
+// password and passcode used for backups created with backupgen
+const (
+	genPassword = "backup-password"
+	genPasscode = "4321"
+)
+
+// presetOptions returns the options of the backupgen preset called name.
+func presetOptions(t *testing.T, name string) backupgen.Options {
+	for _, p := range backupgen.Presets(genPassword, genPasscode) {
+		if p.Name == name {
+			return p.Options
+		}
+	}
+	t.Fatalf("no backupgen preset named %q", name)
+	return backupgen.Options{}
+}
+
 func mkInfo(tm, devname string) []byte {
 	return []byte(fmt.Sprintf(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
 <plist version="1.0"> 
@@ -255,3 +274,31 @@ func TestFindPINFail(t *testing.T) {
 		t.Error("Did not receive expected error")
 	}
 }
+
+func TestProcessBackups(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+
+	dirs, err := discoverBackups(tmpDir)
+	if err != nil {
+		t.Fatal("discoverBackups failed", err)
+	}
+	if len(dirs) != 6 {
+		t.Fatal("Incorrect directory count", len(dirs))
+	}
+
+	loaded := processBackups(dirs, true)
+	if len(loaded) != 5 {
+		t.Fatal("Incorrect backup count", len(loaded))
+	}
+	// results are returned in directory name order
+	expected := []string{"device one", "device two", "device three", "device four", "ios10 device"}
+	for i, b := range loaded {
+		if b.Info.DisplayName != expected[i] {
+			t.Errorf("Entry %d is %q, expected %q", i, b.Info.DisplayName, expected[i])
+		}
+	}
+	if loaded[0].Passcode != dataPIN || loaded[4].Passcode != dataPIN {
+		t.Error("Passcodes not found")
+	}
+}
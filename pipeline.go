@@ -0,0 +1,101 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// job carries a single backup through the processing pipeline.
+type job struct {
+	idx int
+	src backupSource
+	b   *backup
+}
+
+func defaultWorkers() int {
+	if n := runtime.NumCPU(); n < 4 {
+		return n
+	}
+	return 4
+}
+
+// runStage starts n workers that call fn for each job received from in,
+// forwarding the job to the returned channel if fn returns true.
+// The returned channel is closed once in has been drained.
+func runStage(n int, in <-chan *job, fn func(j *job) bool) <-chan *job {
+	out := make(chan *job)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range in {
+				if fn(j) {
+					out <- j
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// processBackups loads the backups in sources concurrently.  Each source passes
+// through metadata parsing, then decryption and extraction of the passcode
+// information, and finally the passcode search if crack is true; each stage
+// runs up to -workers backups at a time.
+//
+// Sources that don't hold a backup are skipped; the remaining backups are
+// returned in the same order as sources, regardless of the order they completed.
+func processBackups(sources []backupSource, crack bool) []*backup {
+	n := *workers
+	if n < 1 {
+		n = 1
+	}
+
+	discovered := make(chan *job)
+	go func() {
+		for i, src := range sources {
+			discovered <- &job{idx: i, src: src}
+		}
+		close(discovered)
+	}()
+
+	parsed := runStage(n, discovered, func(j *job) bool {
+		j.b, _ = loadBackupInfo(j.src)
+		if j.b == nil {
+			return false
+		}
+		events.emit(discoveredEvent(j.b))
+		return true
+	})
+	extracted := runStage(n, parsed, func(j *job) bool {
+		j.b.extract()
+		return true
+	})
+	done := runStage(n, extracted, func(j *job) bool {
+		if crack {
+			j.b.findPasscode()
+		}
+		return true
+	})
+
+	results := make([]*backup, len(sources))
+	for j := range done {
+		results[j.idx] = j.b
+	}
+
+	loaded := make([]*backup, 0, len(sources))
+	for _, b := range results {
+		if b != nil {
+			loaded = append(loaded, b)
+		}
+	}
+	return loaded
+}
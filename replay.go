@@ -0,0 +1,219 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const msgReplayNoHash = "bundle doesn't include the restrictions hash"
+
+// replayedBackup is a backup reconstructed from a diagnostic bundle.
+type replayedBackup struct {
+	*backup
+	Recorded string // the status recorded in the bundle
+	Snapshot string // state of the backup according to its Status.plist, if captured
+	HashFrom string // where the restrictions hash was read from
+}
+
+// parseDebugInfo populates b from the text written by debugInfo, returning
+// the recorded status.  backupInfoTpl is an html/template, so values are
+// unescaped first.
+func parseDebugInfo(text string, b *backup) (status string, err error) {
+	s := bufio.NewScanner(strings.NewReader(text))
+	for s.Scan() {
+		i := strings.Index(s.Text(), ":")
+		if i < 0 {
+			continue
+		}
+		name, value := s.Text()[:i], html.UnescapeString(strings.TrimSpace(s.Text()[i+1:]))
+		switch name {
+		case "Path":
+			b.Path = value
+		case "Status":
+			status = value
+		case "RestrictionPath":
+			b.RestrictionsPath = value
+		case "IsEncrypted":
+			b.Manifest.IsEncrypted = parseTemplateValue(value)
+		case "Key":
+			b.Restrictions.Key, err = parseTemplateBytes(value)
+		case "Salt":
+			b.Restrictions.Salt, err = parseTemplateBytes(value)
+		case "LastBackup":
+			b.Info.LastBackup, _ = time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", value)
+		case "DisplayName":
+			b.Info.DisplayName = value
+		case "ProductName":
+			b.Info.ProductName = value
+		case "ProductType":
+			b.Info.ProductType = value
+		case "ProductVersion":
+			b.Info.ProductVersion = value
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if b.Path == "" {
+		return "", fmt.Errorf("no backup path recorded")
+	}
+	return status, nil
+}
+
+// parseTemplateValue converts the text backupInfoTpl renders for Manifest.IsEncrypted
+// back to its value.
+func parseTemplateValue(s string) interface{} {
+	if v, err := strconv.ParseBool(s); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return v
+	}
+	return nil
+}
+
+// parseTemplateBytes parses a byte slice rendered by backupInfoTpl, such as "[1 2 3]".
+func parseTemplateBytes(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("expected a list of bytes, got %q", s)
+	}
+	var data []byte
+	for _, f := range strings.Fields(s[1 : len(s)-1]) {
+		v, err := strconv.ParseUint(f, 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, byte(v))
+	}
+	return data, nil
+}
+
+// replayBundle reconstructs the backups recorded in a diagnostic bundle and
+// runs them through extraction and the passcode search again.
+//
+// Restrictions plists captured from unencrypted backups are parsed just as
+// they would be from the original backup; otherwise the hash recorded in
+// info.txt is used.  Backups whose hash isn't in the bundle, such as Screen
+// Time backups or those redacted when the bundle was built, can't be replayed.
+func replayBundle(fsys fs.FS) ([]*replayedBackup, error) {
+	infos, err := fs.Glob(fsys, "backups/*/info.txt")
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("no backups found in the diagnostic bundle")
+	}
+	sort.Strings(infos)
+
+	var replayed []*replayedBackup
+	for _, infoFn := range infos {
+		dir := path.Dir(infoFn)
+		text, err := fs.ReadFile(fsys, infoFn)
+		if err != nil {
+			return nil, err
+		}
+		r := &replayedBackup{backup: new(backup)}
+		if r.Recorded, err = parseDebugInfo(string(text), r.backup); err != nil {
+			return nil, fmt.Errorf("%s: %v", infoFn, err)
+		}
+		sub, err := fs.Sub(fsys, dir)
+		if err != nil {
+			return nil, err
+		}
+		r.src = backupSource{fsys: sub, path: r.Path}
+
+		var status struct {
+			SnapshotState string
+			Date          time.Time
+			IsFullBackup  bool
+		}
+		if err := parsePlist(sub, "Status.plist", &status); err == nil {
+			r.Snapshot = fmt.Sprintf("%s at %s", status.SnapshotState, status.Date.UTC().Format(time.RFC3339))
+			if status.IsFullBackup {
+				r.Snapshot += " (full backup)"
+			}
+		}
+
+		capturedPlist := fileExists(sub, restrictionsPlistName) ||
+			fileExists(sub, path.Join(restrictionsPlistName[:2], restrictionsPlistName))
+		switch {
+		case capturedPlist && !r.isEncrypted() && !r.isIOS12():
+			r.Restrictions.Key, r.Restrictions.Salt = nil, nil
+			r.extract()
+			r.HashFrom = "restrictions plist"
+		case len(r.Restrictions.Key) > 0:
+			r.HashFrom = "info.txt"
+		case r.Recorded == msgNoPasscode:
+			r.Status = msgNoPasscode
+		default:
+			r.Status = msgReplayNoHash
+		}
+		r.findPasscode()
+		replayed = append(replayed, r)
+	}
+	return replayed, nil
+}
+
+func runDiagReplay(args []string) {
+	args = parseCommandFlags(args)
+	if len(args) != 1 {
+		exit(102, true, "diag-replay requires a pinfinder-debug.zip file")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		exit(101, false, err.Error())
+	}
+	if strings.HasPrefix(string(data), diagCryptHeader) {
+		exit(102, false, "%s is encrypted; decrypt it with diag-open first", args[0])
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		exit(101, false, "Failed to open diagnostic bundle: %v", err)
+	}
+
+	fmt.Println("Replaying diagnostic bundle", args[0])
+	fmt.Println()
+	replayed, err := replayBundle(zr)
+	if err != nil {
+		exit(101, false, err.Error())
+	}
+
+	allBackups := new(backups)
+	for _, r := range replayed {
+		allBackups.backups = append(allBackups.backups, r.backup)
+	}
+	generateReport(os.Stdout, true, allBackups)
+
+	fmt.Println("Replay details:")
+	for _, r := range replayed {
+		fmt.Printf("  %s\n", path.Base(r.Path))
+		recorded := r.Recorded
+		if recorded == "" {
+			recorded = "passcode found"
+		}
+		fmt.Printf("    %-20s %s\n", "Recorded status:", recorded)
+		if r.Snapshot != "" {
+			fmt.Printf("    %-20s %s\n", "Backup state:", r.Snapshot)
+		}
+		if r.HashFrom != "" {
+			fmt.Printf("    %-20s %s\n", "Hash read from:", r.HashFrom)
+		}
+		fmt.Printf("    %-20s %s\n", "Replay result:", r.result())
+	}
+	fmt.Println()
+	exit(0, false, "")
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+func TestParseDebugInfo(t *testing.T) {
+	var b backup
+	b.Path = "/backups/one"
+	b.Status = msgPINNotFound
+	b.Manifest.IsEncrypted = true
+	b.Restrictions.Key = []byte{0, 1, 255}
+	b.Restrictions.Salt = []byte{42}
+	b.Info.DisplayName = "device: one"
+	b.Info.ProductVersion = "9.3"
+	b.Info.LastBackup = time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	var got backup
+	status, err := parseDebugInfo(b.debugInfo(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != b.Status || got.Path != b.Path || !got.isEncrypted() ||
+		got.Info.DisplayName != b.Info.DisplayName || got.Info.ProductVersion != "9.3" ||
+		!got.Info.LastBackup.Equal(b.Info.LastBackup) ||
+		!bytes.Equal(got.Restrictions.Key, b.Restrictions.Key) || !bytes.Equal(got.Restrictions.Salt, b.Restrictions.Salt) {
+		t.Errorf("incorrect backup parsed: status=%q %+v", status, got)
+	}
+
+	if _, err := parseDebugInfo("Key: [1 2 300]\nPath: x\n", &got); err == nil {
+		t.Error("no error for an invalid key")
+	}
+}
+
+func TestDiagReplay(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	outDir := t.TempDir()
+
+	withPasswords(t, &passwordSource{})
+	dirs, _ := discoverBackups(tmpDir)
+	allBackups := new(backups)
+	allBackups.add(processBackups(dirs, true))
+	original := make(map[string]*backup)
+	for _, b := range allBackups.backups {
+		original[filepath.Base(b.Path)] = b
+	}
+
+	for _, level := range []string{redactNone, redactMetadata} {
+		fn, err := buildDebug(outDir, level, allBackups, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.OpenReader(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed, err := replayBundle(zr)
+		zr.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", level, err)
+		}
+		if len(replayed) != len(allBackups.backups) {
+			t.Fatalf("%s: expected %d backups, got %d", level, len(allBackups.backups), len(replayed))
+		}
+
+		for _, r := range replayed {
+			b := original[filepath.Base(r.Path)]
+			switch {
+			case len(b.Restrictions.Key) == 0:
+				if r.Passcode != "" {
+					t.Errorf("%s %s: unexpected passcode %q", level, r.Path, r.Passcode)
+				}
+			case level == redactNone:
+				if r.Passcode != b.Passcode || r.HashFrom == "" {
+					t.Errorf("%s %s: expected passcode %q from the bundle, got %q (%s)", level, r.Path, b.Passcode, r.result(), r.HashFrom)
+				}
+			default:
+				if r.Status != msgReplayNoHash {
+					t.Errorf("%s %s: expected redacted hash, got %q", level, r.Path, r.result())
+				}
+			}
+		}
+	}
+}
+
+// TestDiagReplayBundles replays a bundle built from generated backups, along
+// with any bundles from bug reports saved in testdata/replay, checking that
+// the passcode is found for every backup that includes a restrictions hash.
+func TestDiagReplayBundles(t *testing.T) {
+	tmpDir := t.TempDir()
+	presets := []string{"legacy plain (iOS 9)", "legacy encrypted (iOS 11)"}
+	for _, name := range presets {
+		if err := backupgen.Generate(filepath.Join(tmpDir, "backups", name), presetOptions(t, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withPasswords(t, &passwordSource{candidates: []candidate{{genPassword, "test"}}})
+	dirs, _ := discoverBackups(filepath.Join(tmpDir, "backups"))
+	allBackups := new(backups)
+	allBackups.add(processBackups(dirs, true))
+	generated, err := buildDebug(tmpDir, redactNone, allBackups, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundles, err := filepath.Glob(filepath.Join("testdata", "replay", "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundles = append(bundles, generated)
+
+	var count int
+	for _, fn := range bundles {
+		zr, err := zip.OpenReader(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed, err := replayBundle(zr)
+		zr.Close()
+		if err != nil {
+			t.Errorf("%s: %v", fn, err)
+			continue
+		}
+		for _, r := range replayed {
+			count++
+			switch {
+			case r.Failed:
+				t.Errorf("%s: failed to find passcode for %s", fn, r.Path)
+			case fn == generated && r.Passcode != genPasscode:
+				t.Errorf("%s: expected passcode %q, got %q", r.Path, genPasscode, r.result())
+			}
+		}
+	}
+	if count < len(presets) {
+		t.Errorf("expected at least %d backups to be replayed, got %d", len(presets), count)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const reportDateFormat = "Jan _2, 2006 03:04 PM MST"
+
+// reportFormats holds the renderers selected by -format.
+var reportFormats = map[string]func(w io.Writer, allBackups *backups) error{
+	"text": func(w io.Writer, allBackups *backups) error {
+		generateReport(w, false, allBackups)
+		return nil
+	},
+	"html": func(w io.Writer, allBackups *backups) error {
+		return htmlReportTpl.Execute(w, newReportData(allBackups))
+	},
+	"markdown": func(w io.Writer, allBackups *backups) error {
+		return markdownReportTpl.Execute(w, newReportData(allBackups))
+	},
+}
+
+func reportFormatNames() (names []string) {
+	for name := range reportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reportData is the information rendered by the html and markdown reports,
+// and the data passed to -template templates.
+type reportData struct {
+	Version   string         // pinfinder's version
+	Generated time.Time      // when the report was made
+	Backups   []reportBackup // newest backup first
+}
+
+// reportBackup describes a single backup and its result in terms that make
+// sense to someone who isn't familiar with pinfinder.
+type reportBackup struct {
+	Path           string
+	DeviceName     string
+	ProductName    string // for example "iPhone"
+	ProductType    string // for example "iPhone10,3"
+	ProductVersion string // iOS version
+	UDID           string
+	LastBackup     time.Time
+	Encrypted      bool
+	ScreenTime     bool   // true if the backup stores a Screen Time passcode, rather than a restrictions passcode
+	Outcome        string // one of found, not_found, no_passcode or error
+	Passcode       string
+	Status         string
+	Result         string // the passcode, or the status if it wasn't found
+	UnlockedBy     string
+	Cached         bool   // true if the result was loaded from the result cache
+	Explanation    string // what the result means
+	NextSteps      string // what to do about it
+
+	// Timings holds the time taken by each step of processing the backup
+	// that was timed: extract, decrypt and search.
+	Timings map[string]time.Duration
+}
+
+func newReportData(allBackups *backups) reportData {
+	data := reportData{Version: version, Generated: time.Now()}
+	for _, b := range allBackups.backups {
+		data.Backups = append(data.Backups, newReportBackup(b))
+	}
+	return data
+}
+
+func newReportBackup(b *backup) reportBackup {
+	r := newHookResult(b, true)
+	rb := reportBackup{
+		Path:           r.Path,
+		DeviceName:     r.DeviceName,
+		ProductName:    r.ProductName,
+		ProductType:    r.ProductType,
+		ProductVersion: r.ProductVersion,
+		UDID:           r.UDID,
+		LastBackup:     r.LastBackup,
+		Encrypted:      r.Encrypted,
+		ScreenTime:     r.ScreenTime,
+		Outcome:        r.Outcome,
+		Passcode:       r.Passcode,
+		Status:         r.Status,
+		Result:         b.result(),
+		UnlockedBy:     r.UnlockedBy,
+		Cached:         r.Cached,
+		Timings:        make(map[string]time.Duration),
+	}
+	rb.Explanation, rb.NextSteps = explainResult(b)
+	for _, s := range b.trace {
+		if s.Elapsed > 0 {
+			rb.Timings[s.Step] += time.Duration(s.Elapsed * float64(time.Second))
+		}
+	}
+	return rb
+}
+
+const failedExplanation = "The backup holds the restrictions passcode hash, but none of the passcodes from 0000 to 9999 matched it."
+
+// explainResult describes what the result for b means and what to do next.
+func explainResult(b *backup) (explanation, nextSteps string) {
+	switch {
+	case b.Passcode != "" && (b.UsesScreenTime || b.isIOS12()):
+		return "The Screen Time passcode was recovered from the backup's keychain.",
+			"Enter the passcode in Settings > Screen Time to change it or turn Screen Time off."
+	case b.Passcode != "":
+		return "The restrictions passcode was recovered from the backup.",
+			"Enter the passcode in Settings > General > Restrictions to change it or turn restrictions off."
+	case b.Failed && b.failureReport != "":
+		return failedExplanation,
+			"Please report this at https://github.com/gwatts/pinfinder/issues and attach " + b.failureReport + ", which pinfinder created."
+	case b.Failed:
+		return failedExplanation, "Please report this at https://github.com/gwatts/pinfinder/issues."
+	}
+
+	switch b.Status {
+	case msgNoPasscode:
+		if majorVersion(b.Info.ProductVersion) >= 13 {
+			return "iOS 13 and later don't store the Screen Time passcode in backups.",
+				"See https://pinfinder.net/faq.html#ios13 for other ways to reset it."
+		}
+		return "The backup doesn't hold a restrictions or Screen Time passcode, so none was set when it was made.",
+			"If a passcode has been set since, back up the device again and rerun pinfinder."
+	case msgEncryptedNeeded:
+		return "iOS 12 and later only include the Screen Time passcode in encrypted backups, and this backup isn't encrypted.",
+			"Turn on \"Encrypt local backup\" in iTunes or Finder, back up the device again and rerun pinfinder."
+	case msgIsEncrypted, msgNoPassword:
+		return "The backup is encrypted and no encryption password was given.",
+			"Rerun pinfinder and enter the password that was set when backup encryption was turned on."
+	case msgIncorrectPassword:
+		return "None of the passwords given unlocked the encrypted backup.",
+			"Rerun pinfinder with the password that was set in iTunes or Finder when backup encryption was turned on."
+	case msgEncryptionDisabled:
+		return "This copy of pinfinder was built without support for encrypted backups.",
+			"Use an official release from https://pinfinder.net."
+	}
+	return fmt.Sprintf("The backup couldn't be read: %s.", b.Status),
+		"Back up the device again and rerun pinfinder.  If the problem continues, please report it at https://github.com/gwatts/pinfinder/issues."
+}
+
+var reportFuncs = map[string]interface{}{
+	"date": func(t time.Time) string { return t.In(time.Local).Format(reportDateFormat) },
+	"yesno": func(v bool) string {
+		if v {
+			return "Yes"
+		}
+		return "No"
+	},
+}
+
+var htmlReportTpl = template.Must(template.New("html").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PIN Finder Report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.5em; border-bottom: 1px solid #ddd; vertical-align: top; }
+.backup { page-break-inside: avoid; margin-bottom: 2em; }
+.passcode { font-size: 1.4em; font-weight: bold; }
+.found { color: #070; }
+.not_found, .error { color: #b00; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>PIN Finder Report</h1>
+<p>Generated {{date .Generated}} by PIN Finder {{.Version}} &mdash; <a href="https://pinfinder.net">pinfinder.net</a></p>
+{{- if not .Backups}}
+<p>No backups were found.</p>
+{{- else}}
+<table>
+<thead><tr><th>Device</th><th>iOS</th><th>Last Backup</th><th>Passcode</th></tr></thead>
+<tbody>
+{{- range .Backups}}
+<tr><td>{{.DeviceName}}</td><td>{{.ProductVersion}}</td><td>{{date .LastBackup}}</td><td class="{{.Outcome}}">{{.Result}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+{{- range .Backups}}
+<div class="backup">
+<h2>{{.DeviceName}}</h2>
+<table>
+<tr><th>Model</th><td>{{.ProductName}} ({{.ProductType}})</td></tr>
+<tr><th>iOS Version</th><td>{{.ProductVersion}}</td></tr>
+<tr><th>Last Backup</th><td>{{date .LastBackup}}</td></tr>
+<tr><th>Encrypted</th><td>{{yesno .Encrypted}}{{if .UnlockedBy}} (unlocked with {{.UnlockedBy}}){{end}}</td></tr>
+<tr><th>Passcode</th><td class="{{.Outcome}}{{if .Passcode}} passcode{{end}}">{{.Result}}</td></tr>
+<tr><th>What this means</th><td>{{.Explanation}}</td></tr>
+<tr><th>Next steps</th><td>{{.NextSteps}}</td></tr>
+</table>
+</div>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
+
+// mdEscape escapes the characters that have a meaning in Markdown text and tables.
+var mdEscape = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`,
+	"<", `\<`, ">", `\>`, "|", `\|`, "\n", " ",
+)
+
+var markdownReportTpl = texttemplate.Must(newTextTemplate("markdown").Parse(`# PIN Finder Report
+
+Generated {{date .Generated}} by PIN Finder {{.Version}} - https://pinfinder.net
+{{if not .Backups}}
+No backups were found.
+{{else}}
+| Device | iOS | Last Backup | Passcode |
+| --- | --- | --- | --- |
+{{- range .Backups}}
+| {{md .DeviceName}} | {{md .ProductVersion}} | {{date .LastBackup}} | {{md .Result}} |
+{{- end}}
+{{range .Backups}}
+## {{md .DeviceName}}
+
+- **Model:** {{md .ProductName}} ({{md .ProductType}})
+- **iOS Version:** {{md .ProductVersion}}
+- **Last Backup:** {{date .LastBackup}}
+- **Encrypted:** {{yesno .Encrypted}}{{if .UnlockedBy}} (unlocked with {{md .UnlockedBy}}){{end}}
+- **Passcode:** {{if .Passcode}}**{{.Passcode}}**{{else}}{{md .Status}}{{end}}
+
+{{md .Explanation}}
+
+**Next steps:** {{md .NextSteps}}
+{{end}}{{end}}`))
+
+// newTextTemplate returns an empty text template with the report functions.
+func newTextTemplate(name string) *texttemplate.Template {
+	return texttemplate.New(name).Funcs(reportFuncs).Funcs(texttemplate.FuncMap{
+		"md": mdEscape.Replace,
+	})
+}
+
+// reportTemplate is the template loaded from -template, if set.
+var reportTemplate *texttemplate.Template
+
+// loadReportTemplate parses the text/template in fn, which is rendered with
+// reportData in place of the -format report.
+func loadReportTemplate(fn string) (*texttemplate.Template, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %v", err)
+	}
+	tpl, err := newTextTemplate(filepath.Base(fn)).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %v", err)
+	}
+	return tpl, nil
+}
+
+// applyReportFlags checks -format and loads the -template template.
+func applyReportFlags() {
+	if _, ok := reportFormats[*reportFormat]; !ok {
+		exit(102, true, "-format must be one of %s", strings.Join(reportFormatNames(), ", "))
+	}
+	if *templateFile != "" {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "format" {
+				exit(102, true, "-template can't be used with -format")
+			}
+		})
+		var err error
+		if reportTemplate, err = loadReportTemplate(*templateFile); err != nil {
+			exit(102, false, err.Error())
+		}
+	}
+}
+
+// writeReport writes the report for allBackups in the -format format, or
+// using the -template template, to the -o file, or stdout if it isn't set.
+func writeReport(allBackups *backups) error {
+	render := reportFormats[*reportFormat]
+	if reportTemplate != nil {
+		render = func(w io.Writer, allBackups *backups) error {
+			return reportTemplate.Execute(w, newReportData(allBackups))
+		}
+	}
+	if *outFile == "" {
+		return render(os.Stdout, allBackups)
+	}
+	f, err := os.Create(*outFile)
+	if err != nil {
+		return fmt.Errorf("failed to create report: %v", err)
+	}
+	if err := render(f, allBackups); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	logger.Info("wrote report", "file", *outFile)
+	return nil
+}
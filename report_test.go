@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reportTestBackups() *backups {
+	found := &backup{Path: "b1", Passcode: "1234"}
+	found.Info.DisplayName = "Kid's <iPad>"
+	found.Info.ProductVersion = "9.3.5"
+	found.Info.LastBackup = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	needsEncryption := &backup{Path: "b2", Status: msgEncryptedNeeded}
+	needsEncryption.Info.DisplayName = "Phone | 2"
+	needsEncryption.Info.ProductVersion = "12.4"
+	return &backups{backups: []*backup{found, needsEncryption}}
+}
+
+func TestHTMLReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := reportFormats["html"](&buf, reportTestBackups()); err != nil {
+		t.Fatal("render failed", err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"<h2>Kid&#39;s &lt;iPad&gt;</h2>",
+		`<td class="found passcode">1234</td>`,
+		"The restrictions passcode was recovered from the backup.",
+		"Turn on &#34;Encrypt local backup&#34; in iTunes or Finder",
+		"Jun  1, 2019",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("output missing %q:\n%s", expected, out)
+		}
+	}
+}
+
+func TestMarkdownReport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := reportFormats["markdown"](&buf, reportTestBackups()); err != nil {
+		t.Fatal("render failed", err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		`| Kid's \<iPad\> | 9.3.5 |`,
+		"## Phone \\| 2\n",
+		"- **Passcode:** **1234**",
+		"- **Passcode:** " + msgEncryptedNeeded,
+		"**Next steps:** Turn on \"Encrypt local backup\"",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("output missing %q:\n%s", expected, out)
+		}
+	}
+
+	for _, allBackups := range []*backups{reportTestBackups(), new(backups)} {
+		buf.Reset()
+		reportFormats["markdown"](&buf, allBackups)
+		if out := buf.String(); !strings.HasSuffix(out, ".\n") {
+			t.Errorf("%d backups: report doesn't end with a single newline: %q", len(allBackups.backups), out[len(out)-20:])
+		}
+	}
+}
+
+func TestExplainResult(t *testing.T) {
+	for _, status := range []string{msgNoPasscode, msgIsEncrypted, msgIncorrectPassword, msgNoPassword, msgEncryptedNeeded, msgEncryptionDisabled, "bad plist"} {
+		b := &backup{Status: status}
+		explanation, nextSteps := explainResult(b)
+		if explanation == "" || nextSteps == "" {
+			t.Errorf("%q: missing explanation or next steps", status)
+		}
+	}
+	_, nextSteps := explainResult(&backup{Status: msgPINNotFound, Failed: true, failureReport: "out/" + failureReportName})
+	if !strings.Contains(nextSteps, "out/"+failureReportName) {
+		t.Errorf("failed search doesn't mention the failure report: %q", nextSteps)
+	}
+	_, nextSteps = explainResult(&backup{Status: msgPINNotFound, Failed: true})
+	if strings.Contains(nextSteps, failureReportName) {
+		t.Errorf("failed search mentions a failure report that wasn't written: %q", nextSteps)
+	}
+}
+
+func TestReportTemplate(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ticket.tmpl")
+	tpl := `{{range .Backups}}{{.DeviceName}} ({{.ProductType}}, iOS {{.ProductVersion}}) backed up {{.LastBackup.Format "2006-01-02"}}: {{.Outcome}} {{.Result}}{{with .Timings.search}} in {{.}}{{end}}
+{{end}}`
+	ioutil.WriteFile(fn, []byte(tpl), 0644)
+	tmpl, err := loadReportTemplate(fn)
+	if err != nil {
+		t.Fatal("loadReportTemplate failed", err)
+	}
+
+	allBackups := reportTestBackups()
+	allBackups.backups[0].Info.ProductType = "iPad2,5"
+	allBackups.backups[0].trace = []traceStep{{Step: "search", Elapsed: 1.5}}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, newReportData(allBackups)); err != nil {
+		t.Fatal("Execute failed", err)
+	}
+	expected := `Kid's <iPad> (iPad2,5, iOS 9.3.5) backed up 2019-06-01: found 1234 in 1.5s
+Phone | 2 (, iOS 12.4) backed up 0001-01-01: error need encrypted backup
+`
+	if buf.String() != expected {
+		t.Errorf("incorrect output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	ioutil.WriteFile(fn, []byte("{{.Backups"), 0644)
+	if _, err := loadReportTemplate(fn); err == nil {
+		t.Error("expected error for an invalid template")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gwatts/ios/keychain"
+)
+
+const (
+	screenTimeService = "ParentalControls"
+	keychainAccount   = "acct"
+	keychainModified  = "mdat"
+)
+
+// keychainEntry is a decoded Screen Time keychain item.
+type keychainEntry struct {
+	Class    string // keychain class the item was found in, eg. genp
+	Index    int    // position of the item within its class
+	Account  string
+	Modified time.Time
+	Passcode string
+}
+
+func (e keychainEntry) String() string {
+	s := fmt.Sprintf("%s item %d", e.Class, e.Index)
+	if e.Account != "" {
+		s += ", account " + e.Account
+	}
+	if !e.Modified.IsZero() {
+		s += ", modified " + e.Modified.In(time.Local).Format("Jan _2, 2006 03:04 PM MST")
+	}
+	return s
+}
+
+// keychainItem is a single keychain entry and its attributes.
+type keychainItem struct {
+	Class string // keychain class the item belongs to, eg. genp
+	Index int    // position of the item within its class
+	Attrs map[string]interface{}
+}
+
+// keychainLookup finds items in a decrypted keychain.
+type keychainLookup interface {
+	// findItems returns the items in any class whose attribute attr equals value.
+	findItems(attr string, value interface{}) []keychainItem
+}
+
+// backupKeychain is a keychainLookup for a keychain loaded from a backup.
+type backupKeychain struct {
+	kc *keychain.Keychain
+}
+
+func (bk backupKeychain) findItems(attr string, value interface{}) []keychainItem {
+	classes := []struct {
+		name  string
+		group keychain.KeychainGroup
+	}{
+		{"genp", bk.kc.General},
+		{"inet", bk.kc.Internet},
+		{"cert", bk.kc.Certs},
+		{"keys", bk.kc.Keys},
+	}
+	var items []keychainItem
+	for _, class := range classes {
+		for i, item := range class.group {
+			if m, ok := item.(map[string]interface{}); ok && m[attr] == value {
+				items = append(items, keychainItem{class.name, i, m})
+			}
+		}
+	}
+	return items
+}
+
+// memKeychain is an in-memory keychainLookup.
+type memKeychain []keychainItem
+
+func (mk memKeychain) findItems(attr string, value interface{}) []keychainItem {
+	var items []keychainItem
+	for _, item := range mk {
+		if item.Attrs[attr] == value {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// findPINFromKeychain searches the keychain for Screen Time passcode entries
+// and returns the best match first, followed by any alternatives.
+//
+// Entries whose account is also ParentalControls are preferred, then the most
+// recently modified.
+func findPINFromKeychain(kc keychainLookup) ([]keychainEntry, error) {
+	items := kc.findItems(keychain.KService, screenTimeService)
+	if len(items) == 0 {
+		return nil, errors.New(msgNoPasscode)
+	}
+
+	var entries []keychainEntry
+	for _, item := range items {
+		code, ok := keychainString(item.Attrs[keychain.KData])
+		if !ok || code == "" {
+			continue
+		}
+		e := keychainEntry{Class: item.Class, Index: item.Index, Passcode: code}
+		e.Account, _ = keychainString(item.Attrs[keychainAccount])
+		e.Modified, _ = item.Attrs[keychainModified].(time.Time)
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("Screen Time keychain entry has no passcode")
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		ai, aj := entries[i].Account == screenTimeService, entries[j].Account == screenTimeService
+		if ai != aj {
+			return ai
+		}
+		return entries[i].Modified.After(entries[j].Modified)
+	})
+	return entries, nil
+}
+
+// keychainString decodes a keychain value stored as either a string or data.
+func keychainString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case []byte:
+		return strings.TrimSpace(string(v)), true
+	case string:
+		return strings.TrimSpace(v), true
+	default:
+		return "", false
+	}
+}
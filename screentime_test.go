@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func stItem(class string, index int, attrs map[string]interface{}) keychainItem {
+	attrs["svce"] = screenTimeService
+	return keychainItem{Class: class, Index: index, Attrs: attrs}
+}
+
+func TestScreenTimeFound(t *testing.T) {
+	kc := memKeychain{
+		{Class: "genp", Index: 0, Attrs: map[string]interface{}{"svce": "other", "v_Data": []byte("9999")}},
+		stItem("genp", 1, map[string]interface{}{"acct": screenTimeService, "v_Data": []byte("1234")}),
+	}
+	entries, err := findPINFromKeychain(kc)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(entries) != 1 || entries[0].Passcode != "1234" {
+		t.Errorf("Incorrect entries %+v", entries)
+	}
+	if s := entries[0].String(); s != "genp item 1, account ParentalControls" {
+		t.Errorf("Incorrect description %q", s)
+	}
+}
+
+func TestScreenTimeMissing(t *testing.T) {
+	kc := memKeychain{
+		{Class: "genp", Index: 0, Attrs: map[string]interface{}{"svce": "other", "v_Data": []byte("9999")}},
+	}
+	if _, err := findPINFromKeychain(kc); err == nil || err.Error() != msgNoPasscode {
+		t.Error("Expected msgNoPasscode error, got", err)
+	}
+	if _, err := findPINFromKeychain(memKeychain{}); err == nil {
+		t.Error("Expected error for empty keychain")
+	}
+}
+
+func TestScreenTimeMalformed(t *testing.T) {
+	kc := memKeychain{
+		stItem("genp", 0, map[string]interface{}{"v_Data": 1234}),
+		stItem("genp", 1, map[string]interface{}{}),
+		stItem("genp", 2, map[string]interface{}{"v_Data": []byte("  ")}),
+	}
+	if _, err := findPINFromKeychain(kc); err == nil || err.Error() == msgNoPasscode {
+		t.Error("Expected malformed entry error, got", err)
+	}
+
+	// string values are accepted as well as data
+	kc = append(kc, stItem("inet", 0, map[string]interface{}{"v_Data": "4321\n"}))
+	entries, err := findPINFromKeychain(kc)
+	if err != nil || entries[0].Passcode != "4321" || entries[0].Class != "inet" {
+		t.Errorf("Incorrect result for string entry: %+v %v", entries, err)
+	}
+}
+
+func TestScreenTimeMultiple(t *testing.T) {
+	older := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	kc := memKeychain{
+		stItem("genp", 0, map[string]interface{}{"acct": "other", "mdat": newer, "v_Data": []byte("1111")}),
+		stItem("genp", 1, map[string]interface{}{"acct": screenTimeService, "mdat": older, "v_Data": []byte("2222")}),
+		stItem("genp", 2, map[string]interface{}{"acct": screenTimeService, "mdat": newer, "v_Data": []byte("3333")}),
+	}
+	entries, err := findPINFromKeychain(kc)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	var codes []string
+	for _, e := range entries {
+		codes = append(codes, e.Passcode)
+	}
+	if len(codes) != 3 || codes[0] != "3333" || codes[1] != "2222" || codes[2] != "1111" {
+		t.Errorf("Incorrect entry order %q", codes)
+	}
+
+	b := &backup{UsesScreenTime: true, Keychain: kc}
+	b.findPasscode()
+	if b.Passcode != "3333" || len(b.KeychainEntries) != 3 {
+		t.Errorf("findPasscode chose %q from %d entries", b.Passcode, len(b.KeychainEntries))
+	}
+}
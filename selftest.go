@@ -0,0 +1,87 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+// The password and passcode set on the generated backups.
+const (
+	selftestPassword = "pinfinder-selftest"
+	selftestPasscode = "7392"
+)
+
+// selftest generates a backup for each layout pinfinder supports in a
+// temporary directory, with passcode as their restrictions passcode, recovers
+// their passcodes using the same steps as a normal scan and records in d
+// whether each passcode was found.
+func selftest(d *doctor, passcode string) error {
+	tmpDir, err := ioutil.TempDir("", "pinfinder-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Use only the generated backups' password, and don't touch the user's cache.
+	savedPasswords, savedKey, savedCache := passwords, backupKey, resultCache
+	passwords = &passwordSource{candidates: []candidate{{selftestPassword, "selftest"}}}
+	backupKey, resultCache = nil, nil
+	defer func() { passwords, backupKey, resultCache = savedPasswords, savedKey, savedCache }()
+
+	presets := backupgen.Presets(selftestPassword, passcode)
+	dirs := make([]string, len(presets))
+	for i, preset := range presets {
+		dirs[i] = filepath.Join(tmpDir, fmt.Sprintf("backup%d", i+1))
+		if err := backupgen.Generate(dirs[i], preset.Options); err != nil {
+			return fmt.Errorf("failed to generate %s backup: %v", preset.Name, err)
+		}
+	}
+
+	sources, err := discoverBackups(tmpDir)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]*backup)
+	for _, b := range processBackups(sources, true) {
+		found[b.Path] = b
+	}
+
+	for i, preset := range presets {
+		b := found[dirs[i]]
+		switch {
+		case b == nil:
+			d.fail(preset.Name, "please report this at https://github.com/gwatts/pinfinder/issues", "the generated backup couldn't be read")
+		case b.Passcode == passcode:
+			d.pass(preset.Name, "recovered passcode %s", passcode)
+		case b.isEncrypted() && !decryptEnabled:
+			d.warn(preset.Name, "rebuild pinfinder without -tags nodecrypt", "skipped; this build can't read encrypted backups")
+		default:
+			d.fail(preset.Name, "please report this at https://github.com/gwatts/pinfinder/issues",
+				"expected passcode %s, got %q", passcode, b.result())
+		}
+	}
+	return nil
+}
+
+func runSelftest(args []string) {
+	if len(parseCommandFlags(args)) > 0 {
+		exit(102, true, "selftest doesn't take any arguments")
+	}
+	logger.Info("recovering passcodes from generated backups")
+	var d doctor
+	if err := selftest(&d, selftestPasscode); err != nil {
+		exit(118, false, "Self test failed: %v", err)
+	}
+	d.print(os.Stdout)
+	if d.failed() > 0 {
+		exit(118, false, "")
+	}
+	exit(0, false, "")
+}
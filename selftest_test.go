@@ -0,0 +1,29 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+func TestSelftest(t *testing.T) {
+	var d doctor
+	if err := selftest(&d, "0815"); err != nil {
+		t.Fatal("selftest failed", err)
+	}
+	if len(d.checks) != len(backupgen.Presets("", "")) {
+		t.Fatalf("expected a result for each preset, got %d", len(d.checks))
+	}
+	for _, c := range d.checks {
+		switch {
+		case c.result == checkFail:
+			t.Errorf("%s: %s", c.name, c.detail)
+		case c.result == checkPass && !strings.Contains(c.detail, "0815"):
+			t.Errorf("%s: expected passcode 0815, got %q", c.name, c.detail)
+		}
+	}
+}
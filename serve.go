@@ -0,0 +1,494 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stateReady   = "ready"
+	stateRunning = "running"
+	stateDone    = "done"
+)
+
+var (
+	errUnknownBackup = errors.New("unknown backup")
+	errBackupBusy    = errors.New("recovery is already running for this backup")
+)
+
+// server implements the web interface and JSON API started by the serve command.
+type server struct {
+	syncDirs []string
+
+	mu      sync.Mutex // guards backups, list and the fields of each serverBackup
+	backups map[string]*serverBackup
+	list    []*serverBackup // newest backup first
+}
+
+// serverBackup tracks a backup known to the server and its latest recovery attempt.
+type serverBackup struct {
+	id       string
+	src      backupSource
+	b        *backup
+	state    string
+	progress string
+	password string // password supplied for the running recovery
+}
+
+// backupJSON is the representation of a backup returned by the API.
+type backupJSON struct {
+	ID             string    `json:"id"`
+	Path           string    `json:"path"`
+	DeviceName     string    `json:"deviceName"`
+	ProductType    string    `json:"productType"`
+	ProductVersion string    `json:"productVersion"`
+	LastBackup     time.Time `json:"lastBackup"`
+	Encrypted      bool      `json:"encrypted"`
+	ScreenTime     bool      `json:"screenTime"`
+	State          string    `json:"state"`
+	Progress       string    `json:"progress,omitempty"`
+	Passcode       string    `json:"passcode,omitempty"`
+	Status         string    `json:"status,omitempty"`
+	Failed         bool      `json:"failed,omitempty"`
+	UnlockedBy     string    `json:"unlockedBy,omitempty"`
+}
+
+func newServer(syncDirs []string) *server {
+	return &server{syncDirs: syncDirs, backups: make(map[string]*serverBackup)}
+}
+
+// backupID returns the identifier used for a backup in API URLs.
+func backupID(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// scan looks for backups in the sync directories, adding any it hasn't seen before.
+func (s *server) scan() error {
+	var sources []backupSource
+	for _, dir := range s.syncDirs {
+		found, err := discoverBackups(dir)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, found...)
+	}
+
+	for _, src := range sources {
+		id := backupID(src.path)
+		s.mu.Lock()
+		known := s.backups[id] != nil
+		s.mu.Unlock()
+		if known {
+			continue
+		}
+		b, err := loadBackupInfo(src)
+		if err != nil {
+			continue // not a backup
+		}
+		events.emit(discoveredEvent(b))
+		sb := &serverBackup{id: id, src: src, b: b, state: stateReady}
+		if b.Cached {
+			sb.state = stateDone
+		}
+		s.mu.Lock()
+		s.backups[id] = sb
+		s.list = append(s.list, sb)
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	sort.SliceStable(s.list, func(i, j int) bool {
+		return s.list[i].b.Info.LastBackup.After(s.list[j].b.Info.LastBackup)
+	})
+	s.mu.Unlock()
+	return nil
+}
+
+// recover starts recovering the passcode for a backup in the background.
+func (s *server) recover(id, password string) (backupJSON, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb := s.backups[id]
+	if sb == nil {
+		return backupJSON{}, errUnknownBackup
+	}
+	if sb.state == stateRunning {
+		return backupJSON{}, errBackupBusy
+	}
+	sb.state, sb.progress, sb.password = stateRunning, "Waiting to start", password
+	go s.run(sb)
+	return sb.json(), nil
+}
+
+// run reloads a backup and searches it for its passcode.
+func (s *server) run(sb *serverBackup) {
+	b, err := loadBackupInfo(sb.src)
+	if err != nil {
+		s.mu.Lock()
+		sb.b.Status = "Failed to load backup: " + err.Error()
+		sb.state, sb.progress, sb.password = stateDone, "", ""
+		s.mu.Unlock()
+		return
+	}
+
+	if b.isEncrypted() {
+		s.setProgress(sb, "Decrypting backup")
+	} else {
+		s.setProgress(sb, "Reading backup")
+	}
+	b.extract()
+	s.setProgress(sb, "Searching for passcode")
+	b.findPasscode()
+
+	if resultCache != nil {
+		resultCache.store(b)
+		if err := resultCache.save(); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to update result cache:", err)
+		}
+	}
+
+	s.mu.Lock()
+	sb.b = b
+	sb.state, sb.progress, sb.password = stateDone, "", ""
+	s.mu.Unlock()
+
+	if *onResult != "" {
+		runResultHooks(&backups{backups: []*backup{b}})
+	}
+}
+
+func (s *server) setProgress(sb *serverBackup, msg string) {
+	s.mu.Lock()
+	sb.progress = msg
+	s.mu.Unlock()
+}
+
+// handleEvent updates the progress of running backups from progress events.
+func (s *server) handleEvent(e event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb := s.backups[backupID(e.Path)]
+	if sb == nil || sb.state != stateRunning {
+		return
+	}
+	switch e.Type {
+	case eventPasswordTried:
+		sb.progress = "Checking password"
+	case eventSearchProgress:
+		sb.progress = fmt.Sprintf("Searching for passcode (%d%%)", e.Tried*100/e.Total)
+	}
+}
+
+// promptPassword supplies the password submitted with the recover request
+// in place of prompting the user at the terminal.
+func (s *server) promptPassword(b *backup, attempt, attempts int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sb := s.backups[backupID(b.Path)]; sb != nil {
+		return sb.password
+	}
+	return ""
+}
+
+// json returns the API representation of the backup; the caller must hold s.mu.
+func (sb *serverBackup) json() backupJSON {
+	b := sb.b
+	return backupJSON{
+		ID:             sb.id,
+		Path:           b.Path,
+		DeviceName:     b.Info.DisplayName,
+		ProductType:    b.Info.ProductType,
+		ProductVersion: b.Info.ProductVersion,
+		LastBackup:     b.Info.LastBackup,
+		Encrypted:      b.isEncrypted(),
+		ScreenTime:     b.isIOS12(),
+		State:          sb.state,
+		Progress:       sb.progress,
+		Passcode:       b.Passcode,
+		Status:         b.Status,
+		Failed:         b.Failed,
+		UnlockedBy:     b.UnlockedBy,
+	}
+}
+
+func (s *server) handler() http.Handler {
+	return localOnly(http.HandlerFunc(s.route))
+}
+
+// route dispatches requests by method and path.  ServeMux's method and
+// wildcard patterns aren't used as they depend on the go version in go.mod.
+func (s *server) route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	isAPI := len(parts) >= 2 && parts[0] == "api" && parts[1] == "backups"
+	switch {
+	case r.URL.Path == "/":
+		if allowMethod(w, r, http.MethodGet) {
+			s.handleIndex(w, r)
+		}
+	case isAPI && len(parts) == 2:
+		if allowMethod(w, r, http.MethodGet) {
+			s.handleList(w, r)
+		}
+	case isAPI && len(parts) == 3:
+		if allowMethod(w, r, http.MethodGet) {
+			s.handleGet(w, r, parts[2])
+		}
+	case isAPI && len(parts) == 4 && parts[3] == "recover":
+		if allowMethod(w, r, http.MethodPost) {
+			s.handleRecover(w, r, parts[2])
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allowMethod returns true if r uses method, otherwise replying that the
+// method isn't allowed.  HEAD is allowed wherever GET is.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, servePage)
+}
+
+func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
+	if err := s.scan(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.mu.Lock()
+	result := make([]backupJSON, len(s.list))
+	for i, sb := range s.list {
+		result[i] = sb.json()
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *server) handleGet(w http.ResponseWriter, r *http.Request, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb := s.backups[id]
+	if sb == nil {
+		writeJSONError(w, http.StatusNotFound, errUnknownBackup)
+		return
+	}
+	writeJSON(w, http.StatusOK, sb.json())
+}
+
+// handleRecover starts passcode recovery.  The request body is a JSON object
+// holding the encryption password, if required: {"password": "..."}.
+//
+// Requiring a JSON body stops other web sites from submitting requests using
+// plain HTML forms.
+func (s *server) handleRecover(w http.ResponseWriter, r *http.Request, id string) {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, errors.New("request body must be JSON"))
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+
+	result, err := s.recover(id, req.Password)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusAccepted, result)
+	case errUnknownBackup:
+		writeJSONError(w, http.StatusNotFound, err)
+	case errBackupBusy:
+		writeJSONError(w, http.StatusConflict, err)
+	default:
+		writeJSONError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// localOnly rejects requests that weren't addressed to a loopback host name,
+// protecting the server from DNS rebinding attacks.
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !isLoopback(host) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+func runServe(args []string) {
+	dirs := parseCommandFlags(args)
+	applyFlags()
+
+	host, _, err := net.SplitHostPort(*listenAddr)
+	if err != nil || !isLoopback(host) {
+		exit(102, true, "-listen must be a loopback address such as 127.0.0.1:8484")
+	}
+	if len(dirs) == 0 {
+		if dirs, err = findSyncDirs(); err != nil {
+			exit(101, true, err.Error())
+		}
+	}
+
+	srv := newServer(dirs)
+	if err := srv.scan(); err != nil {
+		if isBadMacPerms(err) != nil {
+			exitBadMacPerms()
+		}
+		exit(101, true, err.Error())
+	}
+
+	// Passwords come from the web page rather than the terminal; each recover
+	// request supplies one attempt.
+	passwords.prompt = srv.promptPassword
+	passwords.attempts = 1
+	passwords.prompted = true // suppresses the terminal prompt banner
+	events.subscribe(srv.handleEvent)
+
+	ln, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		exit(114, false, "Failed to start server: %v", err)
+	}
+	logger.Info("serving backups", "syncDirs", dirs, "address", ln.Addr())
+	fmt.Printf("Open http://%s/ in your web browser; press Ctrl-C to stop\n", ln.Addr())
+	err = http.Serve(ln, srv.handler())
+	exit(114, false, "Server failed: %v", err)
+}
+
+const servePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>PIN Finder</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.5em; border-bottom: 1px solid #ddd; }
+.passcode { font-size: 1.4em; font-weight: bold; }
+.error { color: #b00; }
+.progress { color: #666; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>PIN Finder</h1>
+<p>iOS Screen Time &amp; Restrictions Passcode Finder &mdash; <a href="https://pinfinder.net">pinfinder.net</a></p>
+<table>
+<thead><tr><th>Device</th><th>iOS</th><th>Backup Time</th><th>Encrypted</th><th>Passcode</th><th></th></tr></thead>
+<tbody id="backups"><tr><td colspan="6">Scanning backups...</td></tr></tbody>
+</table>
+<script>
+var passwords = {};
+
+function el(tag, text, cls) {
+	var e = document.createElement(tag);
+	if (text) e.textContent = text;
+	if (cls) e.className = cls;
+	return e;
+}
+
+function recover(b) {
+	fetch("/api/backups/" + b.id + "/recover", {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify({password: passwords[b.id] || ""})
+	}).then(refresh);
+}
+
+function render(list) {
+	var tbody = document.getElementById("backups");
+	tbody.textContent = "";
+	if (list.length == 0) {
+		tbody.appendChild(el("tr")).appendChild(el("td", "No backups found")).colSpan = 6;
+	}
+	list.forEach(function(b) {
+		var tr = tbody.appendChild(el("tr"));
+		tr.appendChild(el("td", b.deviceName));
+		tr.appendChild(el("td", b.productVersion));
+		tr.appendChild(el("td", new Date(b.lastBackup).toLocaleString()));
+		tr.appendChild(el("td", b.encrypted ? "Yes" : "No"));
+		if (b.state == "running") {
+			tr.appendChild(el("td", b.progress + "...", "progress"));
+		} else if (b.passcode) {
+			tr.appendChild(el("td", b.passcode, "passcode"));
+		} else {
+			tr.appendChild(el("td", b.status, b.failed ? "error" : ""));
+		}
+		var action = tr.appendChild(el("td"));
+		if (b.state == "running" || b.passcode) {
+			return;
+		}
+		if (b.encrypted) {
+			var pw = action.appendChild(el("input"));
+			pw.type = "password";
+			pw.placeholder = "Encryption password";
+			pw.value = passwords[b.id] || "";
+			pw.oninput = function() { passwords[b.id] = pw.value; };
+		}
+		var btn = action.appendChild(el("button", "Find passcode"));
+		btn.onclick = function() { recover(b); };
+	});
+}
+
+function refresh() {
+	return fetch("/api/backups").then(function(r) { return r.json(); }).then(function(list) {
+		var active = document.activeElement;
+		if (active && active.tagName == "INPUT") {
+			return; // don't redraw while a password is being typed
+		}
+		render(list);
+	});
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
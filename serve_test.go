@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+func getBackups(t *testing.T, url string) map[string]backupJSON {
+	resp, err := http.Get(url + "/api/backups")
+	if err != nil {
+		t.Fatal("GET failed", err)
+	}
+	defer resp.Body.Close()
+	var list []backupJSON
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal("Failed to decode backup list", err)
+	}
+	result := make(map[string]backupJSON)
+	for _, b := range list {
+		result[b.DeviceName] = b
+	}
+	return result
+}
+
+func postRecover(url, id, body string) (*http.Response, error) {
+	return http.Post(url+"/api/backups/"+id+"/recover", "application/json", bytes.NewBufferString(body))
+}
+
+// waitDone polls the API until the named backup has finished processing.
+func waitDone(t *testing.T, url, name string) backupJSON {
+	for i := 0; i < 200; i++ {
+		if b := getBackups(t, url)[name]; b.State == stateDone {
+			return b
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for", name)
+	return backupJSON{}
+}
+
+func TestServe(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	if decryptEnabled {
+		opts := presetOptions(t, "Screen Time encrypted (iOS 12)")
+		if err := backupgen.Generate(filepath.Join(tmpDir, "ios12"), opts); err != nil {
+			t.Fatal("Generate failed", err)
+		}
+	}
+
+	srv := newServer([]string{tmpDir})
+	withPasswords(t, &passwordSource{attempts: 1, prompted: true, prompt: srv.promptPassword})
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+
+	backups := getBackups(t, ts.URL)
+	if len(backups) != 5 && len(backups) != 6 {
+		t.Fatal("Incorrect backup count", len(backups))
+	}
+	b1 := backups["device one"]
+	if b1.State != stateReady || b1.Encrypted {
+		t.Errorf("Unexpected initial state %#v", b1)
+	}
+
+	if resp, _ := postRecover(ts.URL, b1.ID, `{}`); resp.StatusCode != http.StatusAccepted {
+		t.Fatal("Unexpected recover status", resp.Status)
+	}
+	if b := waitDone(t, ts.URL, "device one"); b.Passcode != dataPIN {
+		t.Errorf("Incorrect passcode %#v", b)
+	}
+
+	if resp, _ := postRecover(ts.URL, "nosuchbackup", `{}`); resp.StatusCode != http.StatusNotFound {
+		t.Error("Unexpected status for unknown backup", resp.Status)
+	}
+	resp, _ := http.Post(ts.URL+"/api/backups/"+b1.ID+"/recover", "application/x-www-form-urlencoded", bytes.NewBufferString("password=x"))
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Error("Unexpected status for form post", resp.Status)
+	}
+
+	if !decryptEnabled {
+		return
+	}
+	id := getBackups(t, ts.URL)["iOS 12 encrypted"].ID
+	postRecover(ts.URL, id, `{"password": "wrong"}`)
+	if b := waitDone(t, ts.URL, "iOS 12 encrypted"); b.Status != msgIncorrectPassword {
+		t.Errorf("Unexpected result for wrong password %#v", b)
+	}
+	postRecover(ts.URL, id, `{"password": "`+genPassword+`"}`)
+	if b := waitDone(t, ts.URL, "iOS 12 encrypted"); b.Passcode != genPasscode || b.UnlockedBy != unlockedByPrompt {
+		t.Errorf("Unexpected result %#v", b)
+	}
+}
+
+func TestServeLocalOnly(t *testing.T) {
+	srv := newServer(nil)
+	req := httptest.NewRequest("GET", "/api/backups", nil)
+	req.Host = "attacker.example.com"
+	w := httptest.NewRecorder()
+	srv.handler().ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected forbidden, got", w.Code)
+	}
+
+	for host, expected := range map[string]bool{"localhost": true, "127.0.0.1": true, "[::1]": true, "0.0.0.0": false, "10.0.0.1": false} {
+		if isLoopback(host) != expected {
+			t.Errorf("isLoopback(%q) != %t", host, expected)
+		}
+	}
+}
+
+func TestServeRoutes(t *testing.T) {
+	srv := newServer(nil)
+	for _, test := range []struct {
+		method, path string
+		expected     int
+	}{
+		{"GET", "/", http.StatusOK},
+		{"POST", "/", http.StatusMethodNotAllowed},
+		{"GET", "/api/backups", http.StatusOK},
+		{"GET", "/api/backups/nosuchbackup", http.StatusNotFound},
+		{"GET", "/api/backups/nosuchbackup/recover", http.StatusMethodNotAllowed},
+		{"GET", "/nosuchpage", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.Host = "localhost"
+		w := httptest.NewRecorder()
+		srv.handler().ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.path, test.expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// backupSource identifies where a backup's files are stored.
+type backupSource struct {
+	fsys fs.FS  // file system rooted at the backup directory
+	path string // path used to describe the backup to the user
+	dir  string // on-disk directory holding the backup; empty if it's in an archive
+}
+
+// dirSource returns a source for a backup held in an on-disk directory.
+func dirSource(dir string) backupSource {
+	return backupSource{fsys: os.DirFS(dir), path: dir, dir: dir}
+}
+
+// archiveFiles lists the files pinfinder reads from a backup; when scanning a tar
+// stream everything else is skipped.
+var archiveFiles = []string{
+	"Info.plist", "Manifest.plist", "Status.plist", "Manifest.db", "Manifest.mbdb",
+	restrictionsPlistName, keychainRecordID,
+}
+
+// isArchive returns true if fn names an archive pinfinder can read backups from.
+// "-" reads a tar stream from stdin.
+func isArchive(fn string) bool {
+	if fn == "-" {
+		return true
+	}
+	lfn := strings.ToLower(fn)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lfn, ext) {
+			fi, err := os.Stat(fn)
+			return err == nil && fi.Mode().IsRegular()
+		}
+	}
+	return false
+}
+
+// openArchive opens a zip or (optionally gzipped) tar archive, or a tar stream on stdin
+// if fn is "-", and returns a source for each backup found inside it.
+//
+// Zip files are read in place.  Tar streams can't be read randomly, so the files
+// pinfinder needs are copied to a temporary directory which is removed by cleanup.
+func openArchive(fn string) (sources []backupSource, cleanup func(), err error) {
+	var fsys fs.FS
+	cleanup = func() {}
+
+	switch lfn := strings.ToLower(fn); {
+	case strings.HasSuffix(lfn, ".zip"):
+		zr, err := zip.OpenReader(fn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open zip file %s: %v", fn, err)
+		}
+		fsys = &zr.Reader
+		cleanup = func() { zr.Close() }
+
+	default:
+		var r io.Reader = os.Stdin
+		if fn != "-" {
+			f, err := os.Open(fn)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to open archive: %v", err)
+			}
+			defer f.Close()
+			r = f
+		}
+		tmp, err := ioutil.TempDir("", "pinfinder-archive")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.RemoveAll(tmp) }
+		if err := extractTar(tmp, r, archiveFiles); err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to read archive %s: %v", fn, err)
+		}
+		fsys = os.DirFS(tmp)
+	}
+
+	roots, err := findBackupsFS(fsys)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	for _, root := range roots {
+		sub, err := fs.Sub(fsys, root)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		sources = append(sources, backupSource{fsys: sub, path: path.Join(filepath.ToSlash(fn), root)})
+	}
+	return sources, cleanup, nil
+}
+
+// extractTar copies the files in the tar stream r whose base name appears in names
+// into dir, preserving their relative paths.  The stream may be gzip compressed.
+func extractTar(dir string, r io.Reader, names []string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !oneOf(path.Base(hdr.Name), names) {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("invalid file name %q in archive", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// maxArchiveDepth limits how deep findBackupsFS looks for backups.
+const maxArchiveDepth = 4
+
+// findBackupsFS returns the directories in fsys that contain an Info.plist and
+// Manifest.plist, in name order.
+func findBackupsFS(fsys fs.FS) (roots []string, err error) {
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // skip unreadable entries
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if fileExists(fsys, path.Join(p, "Info.plist")) && fileExists(fsys, path.Join(p, "Manifest.plist")) {
+			roots = append(roots, p)
+			return fs.SkipDir
+		}
+		if p != "." && strings.Count(p, "/") >= maxArchiveDepth-1 {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err == nil && len(roots) == 0 {
+		err = errors.New("no backups found in archive")
+	}
+	return roots, err
+}
+
+// stageFile copies name from fsys into dir, so that code that requires an on-disk
+// file can read it.
+func stageFile(fsys fs.FS, name, dir string) error {
+	in, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
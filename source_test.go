@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// walkFixture calls fn with the slash separated name and contents of each file in dir.
+func walkFixture(t *testing.T, dir string, fn func(name string, data []byte)) {
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		fn(filepath.ToSlash(filepath.Join("Backup", rel)), data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeZip(t *testing.T, dir, fn string) {
+	f, _ := os.Create(fn)
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	walkFixture(t, dir, func(name string, data []byte) {
+		w, _ := zw.Create(name)
+		w.Write(data)
+	})
+	zw.Close()
+}
+
+func writeTarGz(t *testing.T, dir, fn string) {
+	f, _ := os.Create(fn)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	walkFixture(t, dir, func(name string, data []byte) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+	})
+	tw.Close()
+	gz.Close()
+}
+
+func TestArchives(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	arcDir, _ := ioutil.TempDir("", "pinfinder-arc")
+	defer os.RemoveAll(arcDir)
+
+	zipfn := filepath.Join(arcDir, "backups.zip")
+	tarfn := filepath.Join(arcDir, "backups.tar.gz")
+	writeZip(t, tmpDir, zipfn)
+	writeTarGz(t, tmpDir, tarfn)
+
+	for _, fn := range []string{zipfn, tarfn} {
+		if !isArchive(fn) {
+			t.Errorf("%s not recognised as an archive", fn)
+		}
+		sources, cleanup, err := openArchive(fn)
+		if err != nil {
+			t.Fatalf("openArchive(%s) failed: %v", fn, err)
+		}
+		if len(sources) != 5 {
+			t.Errorf("%s: incorrect backup count %d", fn, len(sources))
+		}
+		loaded := processBackups(sources, true)
+		if len(loaded) != 5 {
+			t.Fatalf("%s: incorrect loaded count %d", fn, len(loaded))
+		}
+		if b := loaded[0]; b.Info.DisplayName != "device one" || b.Passcode != dataPIN {
+			t.Errorf("%s: incorrect result for first backup: %q %q", fn, b.Info.DisplayName, b.Passcode)
+		}
+		if b := loaded[4]; b.Info.DisplayName != "ios10 device" || b.Passcode != dataPIN {
+			t.Errorf("%s: incorrect result for iOS 10 backup: %q %q", fn, b.Info.DisplayName, b.Passcode)
+		}
+		cleanup()
+	}
+}
+
+func TestExtractTarSkipsFiles(t *testing.T) {
+	tmpDir := setupDataDir()
+	defer os.RemoveAll(tmpDir)
+	arcDir, _ := ioutil.TempDir("", "pinfinder-arc")
+	defer os.RemoveAll(arcDir)
+
+	tarfn := filepath.Join(arcDir, "backups.tar.gz")
+	writeTarGz(t, tmpDir, tarfn)
+	f, _ := os.Open(tarfn)
+	defer f.Close()
+
+	out := filepath.Join(arcDir, "out")
+	if err := extractTar(out, io.Reader(f), archiveFiles); err != nil {
+		t.Fatal("extractTar failed", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "Backup", "backup1", "398bc9c2aeeab4cb0c12ada0f52eea12cf14f40c")); err == nil {
+		t.Error("Unneeded file was extracted")
+	}
+	if _, err := os.Stat(filepath.Join(out, "Backup", "backup1", "Info.plist")); err != nil {
+		t.Error("Info.plist was not extracted", err)
+	}
+}
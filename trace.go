@@ -0,0 +1,54 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// traceStep records a decision, timing or error made while processing a
+// backup, for inclusion in diagnostic reports.
+type traceStep struct {
+	Time    time.Time `json:"time"`
+	Step    string    `json:"step"`
+	Detail  string    `json:"detail,omitempty"`
+	Elapsed float64   `json:"elapsedSeconds,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Causes  []string  `json:"causes,omitempty"`
+}
+
+// note records a decision made while processing the backup, and logs it at debug level.
+func (b *backup) note(step, format string, a ...interface{}) {
+	s := traceStep{Time: time.Now(), Step: step, Detail: fmt.Sprintf(format, a...)}
+	b.trace = append(b.trace, s)
+	logger.Debug(s.Detail, "backup", b.Path, "step", step)
+}
+
+// noteErr records an error, along with the errors it wraps, and logs it as a warning.
+func (b *backup) noteErr(step string, err error) {
+	s := traceStep{Time: time.Now(), Step: step, Error: err.Error(), Causes: errorCauses(err)}
+	b.trace = append(b.trace, s)
+	args := []interface{}{"backup", b.Path, "error", err}
+	if len(s.Causes) > 0 {
+		args = append(args, "causes", s.Causes)
+	}
+	logger.Warn(step+" failed", args...)
+}
+
+// noteTime records the time taken by a step that began at start.
+func (b *backup) noteTime(step string, start time.Time) {
+	elapsed := time.Since(start)
+	b.trace = append(b.trace, traceStep{Time: time.Now(), Step: step, Detail: "finished", Elapsed: elapsed.Seconds()})
+	logger.Debug(step+" finished", "backup", b.Path, "elapsed", elapsed)
+}
+
+// errorCauses returns the messages of the errors wrapped by err.
+func errorCauses(err error) (causes []string) {
+	for err = errors.Unwrap(err); err != nil; err = errors.Unwrap(err) {
+		causes = append(causes, fmt.Sprintf("%s (%T)", err, err))
+	}
+	return causes
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2017, Gareth Watts
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// snapshotFinished is the Status.plist SnapshotState of a completed backup.
+const snapshotFinished = "finished"
+
+// backupSnapshot reads the state of the most recent backup written to src.
+//
+// fingerprint changes each time the device is backed up; complete is false
+// while a backup is still being written.  Backups without a Status.plist are
+// identified by the date in their Info.plist instead.
+func backupSnapshot(src backupSource) (fingerprint string, complete bool, err error) {
+	var status struct {
+		SnapshotState string
+		Date          time.Time
+		UUID          string
+	}
+	if err := parsePlist(src.fsys, "Status.plist", &status); err == nil {
+		return status.UUID + " " + status.Date.UTC().Format(time.RFC3339Nano), status.SnapshotState == snapshotFinished, nil
+	}
+
+	var info struct {
+		LastBackup time.Time `plist:"Last Backup Date"`
+	}
+	if err := parsePlist(src.fsys, "Info.plist", &info); err != nil {
+		return "", false, err
+	}
+	return info.LastBackup.UTC().Format(time.RFC3339Nano), true, nil
+}
+
+// watcher polls sync directories for backups that are new or have changed.
+type watcher struct {
+	dirs      []string
+	started   bool
+	processed map[string]string // backup path to the fingerprint last processed
+	writing   map[string]bool   // backups currently being written
+}
+
+func newWatcher(dirs []string) *watcher {
+	return &watcher{dirs: dirs, processed: make(map[string]string), writing: make(map[string]bool)}
+}
+
+// poll returns the backups that have been completed since the previous poll.
+//
+// The first poll records the backups already present without returning them.
+func (w *watcher) poll() ([]backupSource, error) {
+	var sources []backupSource
+	for _, dir := range w.dirs {
+		found, err := discoverBackups(dir)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, found...)
+	}
+
+	var changed []backupSource
+	for _, src := range sources {
+		fingerprint, complete, err := backupSnapshot(src)
+		if err != nil {
+			continue // not a backup, or not far enough along to tell
+		}
+		if w.processed[src.path] == fingerprint {
+			continue
+		}
+		if !complete {
+			if w.started && !w.writing[src.path] {
+				logger.Info("backup in progress", "backup", src.path)
+			}
+			w.writing[src.path] = true
+			continue
+		}
+		delete(w.writing, src.path)
+		w.processed[src.path] = fingerprint
+		if w.started {
+			changed = append(changed, src)
+		}
+	}
+	w.started = true
+	return changed, nil
+}
+
+// watchReport returns the backups to report after batch has been processed.
+// A report written to a file is replaced each time, so if cumulative is true
+// it holds the latest result for every backup in seen, which batch is added to.
+func watchReport(seen map[string]*backup, batch *backups, cumulative bool) *backups {
+	if !cumulative {
+		return batch
+	}
+	for _, b := range batch.backups {
+		seen[b.Path] = b
+	}
+	var all []*backup
+	for _, b := range seen {
+		all = append(all, b)
+	}
+	report := new(backups)
+	report.add(all)
+	return report
+}
+
+func runWatch(args []string) {
+	dirs := parseCommandFlags(args)
+	applyFlags()
+	applyReportFlags()
+
+	if len(dirs) == 0 {
+		var err error
+		if dirs, err = findSyncDirs(); err != nil {
+			exit(101, true, err.Error())
+		}
+	}
+	if *watchInterval <= 0 {
+		exit(102, true, "-interval must be positive")
+	}
+
+	seen := make(map[string]*backup)
+	w := newWatcher(dirs)
+	logger.Info("watching for new or updated backups; press Ctrl-C to stop", "syncDirs", dirs, "interval", *watchInterval)
+	for {
+		sources, err := w.poll()
+		if err != nil {
+			if isBadMacPerms(err) != nil {
+				exitBadMacPerms()
+			}
+			exit(101, true, err.Error())
+		}
+		if len(sources) > 0 {
+			logger.Info("found new or updated backups", "count", len(sources))
+			allBackups := new(backups)
+			allBackups.add(processBackups(sources, true))
+			reportFailures(allBackups)
+			if err := writeReport(watchReport(seen, allBackups, *outFile != "")); err != nil {
+				logger.Warn("failed to write report", "error", err)
+			}
+			if *onResult != "" {
+				runResultHooks(allBackups)
+			}
+			if resultCache != nil {
+				if err := resultCache.storeAll(allBackups); err != nil {
+					fmt.Fprintln(os.Stderr, "Failed to update result cache:", err)
+				}
+			}
+		}
+		time.Sleep(*watchInterval)
+	}
+}
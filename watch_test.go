@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	plist "github.com/DHowett/go-plist"
+	"github.com/gwatts/pinfinder/internal/backupgen"
+)
+
+func TestWatcher(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "pinfinder")
+	defer os.RemoveAll(tmpDir)
+	opts := presetOptions(t, "legacy plain (iOS 11)")
+	generate := func(name string) {
+		if err := backupgen.Generate(filepath.Join(tmpDir, name), opts); err != nil {
+			t.Fatal("Generate failed", err)
+		}
+	}
+	poll := func(w *watcher) []string {
+		sources, err := w.poll()
+		if err != nil {
+			t.Fatal("poll failed", err)
+		}
+		var paths []string
+		for _, src := range sources {
+			paths = append(paths, filepath.Base(src.path))
+		}
+		return paths
+	}
+
+	generate("existing")
+	w := newWatcher([]string{tmpDir})
+	if found := poll(w); len(found) != 0 {
+		t.Error("Existing backups reported on first poll", found)
+	}
+
+	// a backup that's still being written isn't reported until it's finished
+	generate("new")
+	status, _ := plist.Marshal(map[string]interface{}{"SnapshotState": "uploading", "UUID": "x"}, plist.XMLFormat)
+	ioutil.WriteFile(filepath.Join(tmpDir, "new", "Status.plist"), status, 0644)
+	if found := poll(w); len(found) != 0 {
+		t.Error("Incomplete backup reported", found)
+	}
+	generate("new")
+	if found := poll(w); len(found) != 1 || found[0] != "new" {
+		t.Error("New backup not reported", found)
+	}
+	if found := poll(w); len(found) != 0 {
+		t.Error("Backup reported twice", found)
+	}
+
+	// backing up the device again updates the backup's Status.plist
+	generate("existing")
+	if found := poll(w); len(found) != 1 || found[0] != "existing" {
+		t.Error("Updated backup not reported", found)
+	}
+}
+
+func TestWatchReport(t *testing.T) {
+	batch := func(paths ...string) *backups {
+		b := new(backups)
+		for _, p := range paths {
+			b.backups = append(b.backups, &backup{Path: p, Status: p + " result"})
+		}
+		return b
+	}
+	paths := func(b *backups) (p []string) {
+		for _, backup := range b.backups {
+			p = append(p, backup.Path+"="+backup.Status)
+		}
+		sort.Strings(p)
+		return p
+	}
+
+	seen := make(map[string]*backup)
+	if r := watchReport(seen, batch("a"), false); len(r.backups) != 1 || len(seen) != 0 {
+		t.Errorf("non-cumulative report changed: %v %v", paths(r), seen)
+	}
+
+	watchReport(seen, batch("a", "b"), true)
+	updated := batch("b")
+	updated.backups[0].Status = "new result"
+	r := watchReport(seen, updated, true)
+	if expected := []string{"a=a result", "b=new result"}; !reflect.DeepEqual(paths(r), expected) {
+		t.Errorf("expected %v, got %v", expected, paths(r))
+	}
+}